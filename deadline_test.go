@@ -0,0 +1,154 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestDeadlineRefusesStepsAndRollsBack(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	deadline := time.Now().Add(20 * time.Millisecond)
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "deadline", tx.SetDeadline(deadline))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := readyTx.ExecSubTx("credit", 100, "pam"); jujuerrors.Cause(err) != tx.ErrDeadlineExceeded {
+		t.Fatalf("expected ErrDeadlineExceeded, got: %v", err)
+	}
+
+	expected := []string{"debit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+	status, err := readyTx.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Aborted || !status.Deadline.Equal(deadline) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestCoordinatorRollsBackExpiredTransaction(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner crashes after the first step, and its deadline passes
+	storage := memory.NewLogStorage()
+	crashed := tx.New(context.Background(), sagaForTx, storage, "expired", tx.SetDeadline(time.Now().Add(10*time.Millisecond)))
+	if err := crashed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// without the lease, the owner is given the min age after the deadline
+	unleased := struct {
+		tx.Storage
+		tx.TxLister
+	}{storage, storage}
+	coordinator, err := sagaForTx.NewCoordinator(unleased, SetRecoveryMinAge(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := coordinator.RecoverOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	// the running transactions are skipped unless they passed their deadline
+	coordinator, err = sagaForTx.NewCoordinator(storage, SetRecoveryMinAge(time.Hour), SetRecoveryLease("recovery", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err = coordinator.RecoverOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Action != RolledBackTx || reports[0].Err != nil {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	expected := []string{"debit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestStepEndingAfterAbortFails(t *testing.T) {
+	rec := &recorder{}
+	executing, proceed := make(chan struct{}), make(chan struct{})
+	sagaForTx := New()
+	slowDebit := func(c context.Context, amount int, account string) error {
+		close(executing)
+		<-proceed
+		rec.record("debit")
+		return nil
+	}
+	if err := sagaForTx.AddSubTx("debit", slowDebit, rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	owner := tx.New(context.Background(), sagaForTx, storage, "slow", tx.SetDeadline(time.Now().Add(10*time.Millisecond)))
+	if err := owner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- owner.ExecSubTx("debit", 100, "sam")
+	}()
+
+	// the recovery aborts the transaction while its owner is executing the step
+	<-executing
+	time.Sleep(20 * time.Millisecond)
+	coordinator, err := sagaForTx.NewCoordinator(storage, SetRecoveryMinAge(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coordinator.RecoverOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+
+	if err := <-done; jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition, got: %v", err)
+	}
+	if owner.State() != tx.Aborted {
+		t.Fatalf("expected state: %s, got: %s", tx.Aborted, owner.State())
+	}
+	status, err := owner.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Aborted || status.Steps[0].State == tx.StepDone {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
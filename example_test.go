@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	jujuerrors "github.com/juju/errors"
 	"github.com/vkaushik/saga/storage/memory"
 	"github.com/vkaushik/saga/trace"
 	"github.com/vkaushik/saga/tx"
@@ -107,12 +108,6 @@ func TestSagaError(t *testing.T) {
 
 	// create a new transaction
 	readyTx := tx.NewWithLogger(context.Background(), sagaForTx, storageForTx, "transfer-100-from-sam-to-pam", loggerForTx)
-	defer func() {
-		if err := readyTx.End(); err != nil {
-			log.Println("Failed to close transaction.", err.Error())
-			t.Fatal(err)
-		}
-	}()
 
 	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
 		readyTx.RollbackWithInfiniteTries()
@@ -122,4 +117,10 @@ func TestSagaError(t *testing.T) {
 		readyTx.RollbackWithInfiniteTries()
 		t.Log("This is expected to rollback " + err.Error())
 	}
+
+	// the rolled back transaction can't be ended
+	if err := readyTx.End(); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		log.Println("Expected illegal transition on ending the aborted transaction.", err)
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,124 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestExecInfoIsPassedInContext(t *testing.T) {
+	var keys []string
+	var infos []tx.ExecInfo
+	record := func(c context.Context) {
+		info, ok := tx.ExecInfoFrom(c)
+		if !ok {
+			t.Fatal("expected execution info in context")
+		}
+		infos = append(infos, info)
+		keys = append(keys, tx.IdempotencyKeyFrom(c))
+	}
+
+	compensations := 0
+	debit := func(c context.Context, amount int, account string) error {
+		record(c)
+		return nil
+	}
+	refund := func(c context.Context, amount int, account string) error {
+		record(c)
+		if compensations++; compensations == 1 {
+			return errors.New("refund failed")
+		}
+		return nil
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", debit, refund); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "order-1", tx.SetSagaName("order"))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"order-1:1:action", "order-1:1:compensate", "order-1:1:compensate"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected idempotency keys: %v, got: %v", expected, keys)
+	}
+	if infos[0].SagaName() != "order" || infos[0].SubTxID() != "debit" || infos[0].Phase() != tx.ActionPhase {
+		t.Fatalf("unexpected action info: %+v", infos[0])
+	}
+	if infos[1].Attempt() != 1 || infos[2].Attempt() != 2 || infos[2].Phase() != tx.CompensatePhase {
+		t.Fatalf("unexpected compensate info: %+v", infos[1:])
+	}
+	if tx.IdempotencyKeyFrom(context.Background()) != "" {
+		t.Fatal("expected no idempotency key outside of a transaction")
+	}
+}
+
+func TestIdempotencyKeyIsStableAcrossResume(t *testing.T) {
+	var keys []string
+	var attempts []int
+	shipFails := true
+	reserve := func(c context.Context, item string) (error, string) {
+		return nil, "reservation-of-" + item
+	}
+	ship := func(c context.Context, reservationID string) error {
+		info, _ := tx.ExecInfoFrom(c)
+		keys = append(keys, info.IdempotencyKey())
+		attempts = append(attempts, info.Attempt())
+		if shipFails {
+			return errors.New("worker died")
+		}
+		return nil
+	}
+	noop := func(c context.Context, s string) error { return nil }
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", reserve, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("ship", ship, noop); err != nil {
+		t.Fatal(err)
+	}
+	storage := memory.NewLogStorage()
+	order, err := sagaForTx.AddPipeline("order", storage,
+		Step{SubTxID: "reserve", Args: []Arg{Input(0)}},
+		Step{SubTxID: "ship", Args: []Arg{Result("reserve", 0)}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ship step of the pipeline transaction fails, and the process crashes before the rollback
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "t1", tx.SetSagaName("order"), tx.SetInput("book"))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("reserve", "book"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("ship", "reservation-of-book"); err == nil {
+		t.Fatal("expected the ship step to fail")
+	}
+
+	shipFails = false
+	if _, err := order.Resume(context.Background(), "t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"t1:2:action", "t1:2:action"}
+	if !reflect.DeepEqual(keys, expected) || !reflect.DeepEqual(attempts, []int{1, 2}) {
+		t.Fatalf("expected idempotency keys: %v, got: %v, attempts: %v", expected, keys, attempts)
+	}
+}
@@ -0,0 +1,63 @@
+package saga
+
+import (
+	"context"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+// getLogs reads and unmarshalls the logs of the transaction from the memory storage.
+func getLogs(t *testing.T, storage *memory.LogCache, txID string) []log.Log {
+	data, err := storage.GetTxLogs(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := make([]log.Log, 0, len(data))
+	for _, d := range data {
+		var l log.Log
+		if err := marshal.Unmarshal([]byte(d), &l); err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+func TestPanickingActionIsRecordedAsFailure(t *testing.T) {
+	rec := &recorder{}
+	panicking := func(c context.Context, amount int, to string) error {
+		panic("credit service is gone")
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("credit", panicking, rec.action("compensate-credit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "panicking-action")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := readyTx.ExecSubTx("credit", 100, "pam")
+	panicErr, ok := errors.Cause(err).(*tx.PanicError)
+	if !ok {
+		t.Fatalf("expected PanicError, got: %v", err)
+	}
+	if panicErr.Value != "credit service is gone" || len(panicErr.Stack) == 0 {
+		t.Fatalf("unexpected PanicError: %v", panicErr)
+	}
+
+	logs := getLogs(t, storage, "panicking-action")
+	last := logs[len(logs)-1]
+	if last.Type != log.FailSubTx || last.SubTxID != "credit" || last.Error != "panic: credit service is gone" {
+		t.Fatalf("expected failure log for the panic, got: %+v", last)
+	}
+}
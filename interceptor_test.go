@@ -0,0 +1,110 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+type tokenKey struct{}
+
+func TestInterceptorsWrapActionsAndCompensations(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+
+	var calls []string
+	sagaForTx.AddInterceptor(func(ctx context.Context, inv subtx.Invocation, next subtx.Handler) ([]reflect.Value, error) {
+		calls = append(calls, "saga "+inv.Phase.String()+" "+inv.Definition.GetSubTxID())
+		return next(context.WithValue(ctx, tokenKey{}, "secret"), inv)
+	})
+
+	// the interceptor of the SubTx runs within the saga one, and sees the context and args passed by it
+	debit := func(ctx context.Context, inv subtx.Invocation, next subtx.Handler) ([]reflect.Value, error) {
+		calls = append(calls, "debit "+inv.Phase.String())
+		if ctx.Value(tokenKey{}) != "secret" {
+			t.Fatal("expected the token in the context")
+		}
+		if inv.Phase == subtx.ActionPhase && inv.Args[0].Int() != 100 {
+			t.Fatalf("unexpected args: %v", inv.Args)
+		}
+		return next(ctx, inv)
+	}
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit"),
+		subtx.SetInterceptors(debit)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the interceptor short-circuits the failing action with a successful result
+	recovered := func(ctx context.Context, inv subtx.Invocation, next subtx.Handler) ([]reflect.Value, error) {
+		res, err := next(ctx, inv)
+		if err != nil && inv.Phase == subtx.ActionPhase {
+			return []reflect.Value{reflect.Zero(reflect.TypeOf((*error)(nil)).Elem())}, nil
+		}
+		return res, err
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit"),
+		subtx.SetInterceptors(recovered)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the interceptor fails the compensation without calling it
+	blocked := func(ctx context.Context, inv subtx.Invocation, next subtx.Handler) ([]reflect.Value, error) {
+		if inv.Phase == subtx.CompensatePhase {
+			return nil, errors.New("blocked")
+		}
+		return next(ctx, inv)
+	}
+	if err := sagaForTx.AddSubTx("notify", rec.action("notify"), rec.action("compensate-notify"),
+		subtx.SetInterceptors(blocked)); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "intercepted")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"debit", "credit", "notify"} {
+		if err := readyTx.ExecSubTx(id, 100, "sam"); err != nil {
+			t.Fatalf("could not execute %s: %v", id, err)
+		}
+	}
+	if err := readyTx.Rollback(1); err == nil {
+		t.Fatal("expected the blocked compensation to fail the rollback")
+	}
+
+	expected := []string{
+		"saga action debit", "debit action",
+		"saga action credit",
+		"saga action notify",
+		"saga compensate notify",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("unexpected interceptor calls: %v", calls)
+	}
+	if !reflect.DeepEqual(rec.calls, []string{"debit", "credit", "notify"}) {
+		t.Fatalf("unexpected calls: %v", rec.calls)
+	}
+}
+
+func TestInterceptorResultsMustMatchTheFunction(t *testing.T) {
+	sagaForTx := New()
+	sagaForTx.AddInterceptor(func(ctx context.Context, inv subtx.Invocation, next subtx.Handler) ([]reflect.Value, error) {
+		return nil, nil
+	})
+	if err := sagaForTx.AddSubTx("debit", (&recorder{}).action("debit"), (&recorder{}).action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "mismatched")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err == nil {
+		t.Fatal("expected the missing results to fail the action")
+	}
+}
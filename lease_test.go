@@ -0,0 +1,161 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestLeaseFencesOtherOwners(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	owner := tx.New(context.Background(), sagaForTx, storage, "leased", tx.SetLease("worker-1", 30*time.Millisecond))
+	if err := owner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease is renewed in background, so another owner can't take it over
+	time.Sleep(60 * time.Millisecond)
+	other := tx.New(context.Background(), sagaForTx, storage, "leased", tx.SetLease("worker-2", time.Minute))
+	if err := other.Resume(); jujuerrors.Cause(err) != tx.ErrLeaseHeld {
+		t.Fatalf("expected ErrLeaseHeld, got: %v", err)
+	}
+
+	// the owner that lost the lease can't write
+	lease, err := storage.AcquireLease("leased", "worker-2", time.Minute)
+	if err == nil {
+		t.Fatalf("expected the lease to be held, got: %+v", lease)
+	}
+	if err := storage.AppendLogFenced("leased", 0, "{}"); jujuerrors.Cause(err) != tx.ErrFenced {
+		t.Fatalf("expected ErrFenced, got: %v", err)
+	}
+
+	if err := owner.ExecSubTx("credit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease is released on End
+	if _, err := storage.AcquireLease("leased", "worker-2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.ExecSubTx("credit", 100, "pam"); err == nil {
+		t.Fatal("expected the ended transaction to refuse steps")
+	}
+
+	expected := []string{"debit", "credit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestStaleOwnerIsFenced(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	stale := tx.New(ctx, sagaForTx, storage, "fenced", tx.SetLease("worker-1", 10*time.Millisecond))
+	if err := stale.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner stops renewing, e.g. it's paused, and the recovery takes over the expired lease
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	coordinator, err := sagaForTx.NewCoordinator(storage, SetRecoveryLease("recovery", time.Minute), SetRecoveryMinAge(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := coordinator.RecoverOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Action != RolledBackTx || reports[0].Err != nil {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+
+	status, err := tx.New(context.Background(), sagaForTx, storage, "fenced").Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Aborted {
+		t.Fatalf("expected aborted transaction, got: %s", status.State)
+	}
+}
+
+func TestLeaseNeedsPositiveTTL(t *testing.T) {
+	sagaForTx := New()
+	storage := memory.NewLogStorage()
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if err := tx.New(context.Background(), sagaForTx, storage, "unleased", tx.SetLease("worker-1", ttl)).Start(); err == nil {
+			t.Fatalf("expected ttl: %s to be rejected", ttl)
+		}
+	}
+
+	// the ttl too short to renew at a third of it is renewed at the ttl
+	short := tx.New(context.Background(), sagaForTx, storage, "short", tx.SetLease("worker-1", time.Nanosecond))
+	if err := short.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := short.ReleaseLease(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnleasedWritersAreRefusedWhileLeaseIsHeld(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	owner := tx.New(context.Background(), sagaForTx, storage, "owned", tx.SetLease("worker-1", time.Minute))
+	if err := owner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.New(context.Background(), sagaForTx, storage, "owned").ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrLeaseHeld {
+		t.Fatalf("expected ErrLeaseHeld, got: %v", err)
+	}
+
+	// the Coordinator recovers under its own lease by default, so it skips the transaction driven by its owner
+	coordinator, err := sagaForTx.NewCoordinator(storage, SetRecoveryMinAge(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := coordinator.RecoverOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Action != ReportedTx || jujuerrors.Cause(reports[0].Err) != tx.ErrLeaseHeld {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	if len(rec.calls) != 0 {
+		t.Fatalf("expected no calls, got: %v", rec.calls)
+	}
+
+	if err := owner.End(); err != nil {
+		t.Fatal(err)
+	}
+}
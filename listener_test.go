@@ -0,0 +1,69 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestListenersAreNotifiedOfLifecycleEvents(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit")); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	var failure error
+	sagaForTx.AddListener(tx.ListenerFunc(func(e tx.Event) error {
+		events = append(events, e.Type.String()+" "+e.SubTxID)
+		if e.Type == tx.EventStepFailed {
+			failure = e.Err
+			if !reflect.DeepEqual(e.Args, []interface{}{100, "pam"}) {
+				t.Fatalf("unexpected args of failed step: %v", e.Args)
+			}
+		}
+		return nil
+	}))
+
+	// the failures of listeners don't affect the transaction
+	failing := tx.ListenerFunc(func(e tx.Event) error { return errors.New("listener failed") })
+	panicking := tx.ListenerFunc(func(e tx.Event) error { panic("listener panicked") })
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "listened",
+		tx.SetListeners(failing, panicking))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("credit", 100, "pam"); err == nil {
+		t.Fatal("expected credit to fail")
+	}
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"TxStarted ",
+		"StepStarted debit", "StepSucceeded debit",
+		"StepStarted credit", "StepFailed credit",
+		"CompensationStarted credit", "CompensationSucceeded credit",
+		"CompensationStarted debit", "CompensationSucceeded debit",
+		"TxAborted ",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected events: %v, got: %v", expected, events)
+	}
+	if failure == nil || failure.Error() != "credit failed" {
+		t.Fatalf("expected failure of credit, got: %v", failure)
+	}
+}
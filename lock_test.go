@@ -0,0 +1,189 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+func accountKeys(amount int, account string) []string {
+	return []string{"account:" + account}
+}
+
+func lockingSaga(t *testing.T, policy subtx.LockConflictPolicy) *Saga {
+	rec := &recorder{}
+	s := New()
+	if err := s.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit"),
+		subtx.SetLockKeys(accountKeys), subtx.SetLockConflictPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func startedTx(t *testing.T, s *Saga, st tx.Storage, txID string, options ...func(*tx.Tx)) tx.ReadyTx {
+	readyTx := tx.New(context.Background(), s, st, txID, options...)
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return readyTx
+}
+
+func TestLocksAreHeldUntilTheTransactionIsDone(t *testing.T) {
+	s, st := lockingSaga(t, subtx.FailOnConflict), memory.NewLogStorage()
+
+	first, second := startedTx(t, s, st, "first"), startedTx(t, s, st, "second")
+	if err := first.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.ExecSubTx("debit", 50, "sam"); err != nil {
+		t.Fatalf("expected the lock to be reentrant: %v", err)
+	}
+	if err := second.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrLocked {
+		t.Fatalf("expected ErrLocked, got: %v", err)
+	}
+	if err := second.ExecSubTx("debit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.End(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatalf("expected the lock to be released by End: %v", err)
+	}
+
+	// the resumed Transaction releases the locks taken before it's resumed
+	resumed := tx.New(context.Background(), s, st, "second")
+	if err := resumed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	third := startedTx(t, s, st, "third")
+	if err := third.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatalf("expected the lock to be released by the rollback: %v", err)
+	}
+}
+
+func TestLockConflictPolicies(t *testing.T) {
+	t.Run("flag", func(t *testing.T) {
+		s, st := lockingSaga(t, subtx.FlagOnConflict), memory.NewLogStorage()
+		var conflicts []tx.Event
+		s.AddListener(tx.ListenerFunc(func(e tx.Event) error {
+			if e.Type == tx.EventLockConflict {
+				conflicts = append(conflicts, e)
+			}
+			return nil
+		}))
+
+		if err := startedTx(t, s, st, "first").ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+		if err := startedTx(t, s, st, "second").ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatalf("expected the conflict to be flagged: %v", err)
+		}
+		if len(conflicts) != 1 || conflicts[0].TxID != "second" || jujuerrors.Cause(conflicts[0].Err) != tx.ErrLocked {
+			t.Fatalf("unexpected conflicts: %v", conflicts)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		s, st := lockingSaga(t, subtx.WaitOnConflict), memory.NewLogStorage()
+		first := startedTx(t, s, st, "first")
+		if err := first.ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+
+		second, done := startedTx(t, s, st, "second"), make(chan error)
+		go func() {
+			done <- second.ExecSubTx("debit", 100, "sam")
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("expected to wait for the lock, got: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if err := first.End(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("expected the lock after End: %v", err)
+		}
+
+		// the wait ends with the deadline of the Transaction
+		expiring := startedTx(t, s, st, "expiring", tx.SetDeadline(time.Now().Add(100*time.Millisecond)))
+		if err := expiring.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrLocked {
+			t.Fatalf("expected ErrLocked, got: %v", err)
+		}
+	})
+}
+
+func TestLockOptionsAreValidated(t *testing.T) {
+	rec := &recorder{}
+	s := New()
+	if err := s.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit"),
+		subtx.SetLockConflictPolicy(subtx.WaitOnConflict)); err == nil {
+		t.Fatal("expected the policy without lock keys to be rejected")
+	}
+	if err := s.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit"),
+		subtx.SetLockKeys(func(account string) []string { return nil })); err == nil {
+		t.Fatal("expected the lock keys not accepting the action arguments to be rejected")
+	}
+}
+
+// releaseCounter counts the calls to ReleaseLocks of the storage.
+type releaseCounter struct {
+	*memory.LogCache
+	releases int
+}
+
+func (c *releaseCounter) ReleaseLocks(id string) error {
+	c.releases++
+	return c.LogCache.ReleaseLocks(id)
+}
+
+func TestLocksAcquiredBeforeTheyAreLoggedAreReleased(t *testing.T) {
+	s, st := lockingSaga(t, subtx.FailOnConflict), &releaseCounter{LogCache: memory.NewLogStorage()}
+
+	// the process dies after logging the intent and locking the resource, before the SubTx is logged
+	startedTx(t, s, st, "crashed")
+	intent, err := marshal.Marshal(log.Log{Type: log.LockSubTx, SubTxID: "debit", Time: time.Now(), Locks: []string{"account:sam"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AppendLog("crashed", intent); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AcquireLocks("crashed", []string{"account:sam"}); err != nil {
+		t.Fatal(err)
+	}
+	other := startedTx(t, s, st, "other")
+	if err := other.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrLocked {
+		t.Fatalf("expected ErrLocked, got: %v", err)
+	}
+
+	if err := tx.New(context.Background(), s, st, "crashed").Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatalf("expected the lock to be released by the rollback: %v", err)
+	}
+
+	// the Transaction that never locked doesn't release
+	st.releases = 0
+	if err := startedTx(t, s, st, "unlocked").End(); err != nil {
+		t.Fatal(err)
+	}
+	if st.releases != 0 {
+		t.Fatalf("expected no release of locks, got: %d", st.releases)
+	}
+}
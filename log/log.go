@@ -28,14 +28,36 @@ const (
 
 	// AbortTx denotes the abort of a Transaction
 	AbortTx
+
+	// FailSubTx denotes the failure of a Sub-Transaction action, the Error contains the reason
+	FailSubTx
+
+	// FailCompensateSubTx denotes the failure of a Sub-Transaction compensate, the Error contains the reason
+	FailCompensateSubTx
+
+	// CompensationFailedTx denotes that the rollback of a Transaction is given up, the Error contains the reason
+	CompensationFailedTx
+
+	// AbortedTx denotes the end of the rollback of a Transaction
+	AbortedTx
+
+	// LockSubTx denotes that a Sub-Transaction is about to lock resources, the Locks contain their keys
+	LockSubTx
 )
 
 // Log is used by Saga to compensate a SubTx. Logs persisted in storage are the source of truth to know the state of a Transaction.
 type Log struct {
-	Type    Type      `json:"type,omitempty"`
-	SubTxID string    `json:"sub_tx_ID,omitempty"`
-	Time    time.Time `json:"time,omitempty"`
-	Args    []ArgData `json:"args,omitempty"`
+	Type     Type       `json:"type,omitempty"`
+	Name     string     `json:"name,omitempty"` // Name is the saga type of the Transaction, it's logged with the start of Transaction.
+	SubTxID  string     `json:"sub_tx_ID,omitempty"`
+	Seq      int        `json:"seq,omitempty"`     // Seq identifies a single execution of a SubTx, it's shared by all the logs of that execution.
+	Attempt  int        `json:"attempt,omitempty"` // Attempt is the attempt number of the SubTx action or compensate.
+	Time     time.Time  `json:"time,omitempty"`
+	Args     []ArgData  `json:"args,omitempty"`
+	Results  []ArgData  `json:"results,omitempty"`  // Results are the non-error values returned by the action, logged with the end of SubTx.
+	Error    string     `json:"error,omitempty"`    // Error is the message of the error returned by a failed action or compensate.
+	Deadline *time.Time `json:"deadline,omitempty"` // Deadline is the time by which the Transaction must finish, if it's set.
+	Locks    []string   `json:"locks,omitempty"`    // Locks are the keys of the resources locked by the SubTx, logged with its start.
 }
 
 // ArgData is used by Log to contain the arguments passed to SubTx. It's used to store and restore SubTx input args from logs.
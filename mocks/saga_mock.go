@@ -35,17 +35,22 @@ func (m *MockSubTxDefinitions) EXPECT() *MockSubTxDefinitionsMockRecorder {
 }
 
 // Add mocks base method.
-func (m *MockSubTxDefinitions) Add(subTxID string, action, compensate interface{}) error {
+func (m *MockSubTxDefinitions) Add(subTxID string, action, compensate interface{}, options ...func(*subtx.Definition) error) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Add", subTxID, action, compensate)
+	varargs := []interface{}{subTxID, action, compensate}
+	for _, a := range options {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Add", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Add indicates an expected call of Add.
-func (mr *MockSubTxDefinitionsMockRecorder) Add(subTxID, action, compensate interface{}) *gomock.Call {
+func (mr *MockSubTxDefinitionsMockRecorder) Add(subTxID, action, compensate interface{}, options ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockSubTxDefinitions)(nil).Add), subTxID, action, compensate)
+	varargs := append([]interface{}{subTxID, action, compensate}, options...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockSubTxDefinitions)(nil).Add), varargs...)
 }
 
 // Get mocks base method.
@@ -0,0 +1,578 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+// Step is a SubTx executed by the Pipeline.
+// Args provide the arguments of the SubTx action, if they're nil the Pipeline input is passed as arguments.
+type Step struct {
+	SubTxID string
+	Args    []Arg
+}
+
+// Arg provides an argument of a Step when the Step is executed. See Input, Value and Result.
+type Arg interface {
+	resolve(input []interface{}, results map[string][]reflect.Value) (interface{}, error)
+}
+
+type inputArg int
+
+func (i inputArg) resolve(input []interface{}, results map[string][]reflect.Value) (interface{}, error) {
+	if int(i) < 0 || int(i) >= len(input) {
+		return nil, errors.Errorf("pipeline input has no argument at index: %d", i)
+	}
+	return input[i], nil
+}
+
+// Input is the Arg that takes the i-th argument of the Pipeline input.
+func Input(i int) Arg {
+	return inputArg(i)
+}
+
+type valueArg struct {
+	value interface{}
+}
+
+func (v valueArg) resolve(input []interface{}, results map[string][]reflect.Value) (interface{}, error) {
+	return v.value, nil
+}
+
+// Value is the Arg that always provides the given value.
+func Value(v interface{}) Arg {
+	return valueArg{value: v}
+}
+
+type resultArg struct {
+	subTxID string
+	index   int
+}
+
+func (r resultArg) resolve(input []interface{}, results map[string][]reflect.Value) (interface{}, error) {
+	res, ok := results[r.subTxID]
+	if !ok {
+		return nil, errors.Errorf("step: %s is not executed", r.subTxID)
+	}
+	if r.index < 0 || r.index >= len(res) {
+		return nil, errors.Errorf("step: %s has no result at index: %d", r.subTxID, r.index)
+	}
+	return res[r.index].Interface(), nil
+}
+
+// Result is the Arg that takes the i-th non-error result of the action of the Step identified by subTxID,
+// e.g. Result("reserve", 0) takes the ReservationID returned by func(ctx, item string) (error, ReservationID).
+// The Step must depend on the Step identified by subTxID. The results are logged with the end of SubTx,
+// so they're restored from the logs when the Transaction is resumed. Hence AddGraph rejects the Result of an action
+// whose results can't be logged, e.g. interfaces that may be nil, channels or functions.
+func Result(subTxID string, i int) Arg {
+	return resultArg{subTxID: subTxID, index: i}
+}
+
+// OutcomeStatus is the status of the Transaction after a Pipeline run.
+type OutcomeStatus int
+
+const (
+	// NotStarted denotes that the Transaction could not be started.
+	NotStarted OutcomeStatus = iota + 1
+
+	// Committed denotes that all the Steps are executed and the Transaction is ended.
+	Committed
+
+	// RolledBack denotes that a Step failed and the Transaction is rolled back.
+	RolledBack
+
+	// RollbackFailed denotes that a Step failed and the Transaction could not be rolled back.
+	RollbackFailed
+
+	// Incomplete denotes that all the Steps are executed but the Transaction could not be ended.
+	Incomplete
+)
+
+// Outcome is the structured result of a Pipeline run.
+type Outcome struct {
+	TxID   string
+	Status OutcomeStatus
+
+	// FailedStep is the SubTxID of the Step that failed, if any.
+	FailedStep string
+
+	// Results are the non-error results returned by the action of each executed Step, by SubTxID.
+	Results map[string][]reflect.Value
+}
+
+// Node is a Step of a graph Pipeline, with the SubTxIDs of the Steps it depends on.
+type Node struct {
+	Step
+	DependsOn []string
+}
+
+// Pipeline is a named saga type, i.e. a graph of Steps that are executed as a single Transaction by Run.
+// A Step is executed once all the Steps it depends on are executed, independent Steps are executed in parallel.
+type Pipeline struct {
+	name      string
+	saga      *Saga
+	storage   tx.Storage
+	nodes     []Node
+	txOptions []func(*tx.Tx) // txOptions customize the Transactions of the Pipeline, see SetTxOptions.
+}
+
+// AddPipeline declares a Pipeline of given name with the Steps to execute in order, the Transactions of the Pipeline
+// are persisted in given storage. The SubTxs of the Steps must already be added to the saga.
+func (s *Saga) AddPipeline(name string, st tx.Storage, steps ...Step) (*Pipeline, error) {
+	nodes := make([]Node, 0, len(steps))
+	for i, step := range steps {
+		node := Node{Step: step}
+		if i > 0 {
+			node.DependsOn = []string{steps[i-1].SubTxID}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return s.AddGraph(name, st, nodes...)
+}
+
+// AddGraph declares a Pipeline of given name with the Nodes that form a directed acyclic graph, the Transactions
+// of the Pipeline are persisted in given storage. The SubTxs of the Nodes must already be added to the saga.
+// On failure only the executed Nodes are compensated, in the reverse order of their execution.
+func (s *Saga) AddGraph(name string, st tx.Storage, nodes ...Node) (*Pipeline, error) {
+	if _, ok := s.pipelines[name]; ok {
+		return nil, errors.Errorf("pipeline already added with name: %s", name)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.Errorf("pipeline: %s must have at least one step", name)
+	}
+
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if _, err := s.GetSubTxDef(node.SubTxID); err != nil {
+			return nil, errors.Annotatef(err, "invalid step in pipeline: %s", name)
+		}
+		if seen[node.SubTxID] {
+			return nil, errors.Errorf("step with SubTxID: %s is repeated in pipeline: %s", node.SubTxID, name)
+		}
+		seen[node.SubTxID] = true
+	}
+
+	p := &Pipeline{name: name, saga: s, storage: st, nodes: nodes}
+	if err := p.validateGraph(); err != nil {
+		return nil, errors.Annotatef(err, "invalid graph of pipeline: %s", name)
+	}
+	s.pipelines[name] = p
+
+	return p, nil
+}
+
+// validateGraph checks that the dependencies of the Nodes exist and don't form a cycle,
+// and that the Nodes take the Results of only the Nodes they depend on, whose results can be logged.
+func (p *Pipeline) validateGraph() error {
+	pending, dependents, ready := p.graph()
+	for _, node := range p.nodes {
+		for _, dep := range node.DependsOn {
+			if _, ok := pending[dep]; !ok {
+				return errors.Errorf("step: %s depends on unknown step: %s", node.SubTxID, dep)
+			}
+		}
+	}
+
+	ancestors := p.ancestors()
+	for _, node := range p.nodes {
+		for _, arg := range node.Args {
+			r, ok := arg.(resultArg)
+			if !ok {
+				continue
+			}
+			if !ancestors[node.SubTxID][r.subTxID] {
+				return errors.Errorf("step: %s takes result of step: %s without depending on it", node.SubTxID, r.subTxID)
+			}
+			if err := p.validateResults(r.subTxID); err != nil {
+				return errors.Annotatef(err, "step: %s takes result of step: %s", node.SubTxID, r.subTxID)
+			}
+		}
+	}
+
+	visited := 0
+	for len(ready) > 0 {
+		node := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, next := range dependents[node.SubTxID] {
+			pending[next.SubTxID]--
+			if pending[next.SubTxID] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if visited != len(p.nodes) {
+		return errors.New("steps have cyclic dependencies")
+	}
+
+	return nil
+}
+
+// validateResults checks that the results of the action of the SubTx can be logged, so that they can be restored
+// when the Transaction is resumed. The results are logged all together, so every result must be loggable.
+func (p *Pipeline) validateResults(subTxID string) error {
+	subTxDef, err := p.saga.GetSubTxDef(subTxID)
+	if err != nil {
+		return errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", subTxID)
+	}
+
+	actionType := subTxDef.GetAction().Type()
+	for i := 1; i < actionType.NumOut(); i++ {
+		if !loggable(actionType.Out(i)) {
+			return errors.Errorf("result: %d of type: %s can't be logged", i-1, actionType.Out(i))
+		}
+	}
+	return nil
+}
+
+// loggable tells if the values of the type can always be logged, i.e. they're not nil interfaces and can be marshalled.
+func loggable(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return false
+	}
+	_, err := marshal.Marshal(reflect.Zero(t).Interface())
+	return err == nil
+}
+
+// ancestors returns the SubTxIDs of the Nodes each Node depends on, directly or transitively.
+func (p *Pipeline) ancestors() map[string]map[string]bool {
+	dependsOn := make(map[string][]string, len(p.nodes))
+	for _, node := range p.nodes {
+		dependsOn[node.SubTxID] = node.DependsOn
+	}
+
+	ancestors := make(map[string]map[string]bool, len(p.nodes))
+	for _, node := range p.nodes {
+		seen := map[string]bool{}
+		stack := append([]string(nil), node.DependsOn...)
+		for len(stack) > 0 {
+			dep := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			stack = append(stack, dependsOn[dep]...)
+		}
+		ancestors[node.SubTxID] = seen
+	}
+
+	return ancestors
+}
+
+// graph returns the number of pending dependencies of each Node, the dependents of each Node,
+// and the Nodes that have no dependencies.
+func (p *Pipeline) graph() (map[string]int, map[string][]Node, []Node) {
+	pending := make(map[string]int, len(p.nodes))
+	dependents := make(map[string][]Node, len(p.nodes))
+	var ready []Node
+	for _, node := range p.nodes {
+		pending[node.SubTxID] = len(node.DependsOn)
+		for _, dep := range node.DependsOn {
+			dependents[dep] = append(dependents[dep], node)
+		}
+		if len(node.DependsOn) == 0 {
+			ready = append(ready, node)
+		}
+	}
+	return pending, dependents, ready
+}
+
+// GetPipeline returns the Pipeline added with given name.
+func (s *Saga) GetPipeline(name string) (*Pipeline, error) {
+	if p, ok := s.pipelines[name]; ok {
+		return p, nil
+	}
+	return nil, errors.New("could not find pipeline with name: " + name)
+}
+
+// Name returns the name of the Pipeline.
+func (p *Pipeline) Name() string {
+	return p.name
+}
+
+// SetTxOptions sets the functional options from tx package to customize the Transactions run or resumed by the Pipeline,
+// e.g. tx.SetDeadline or tx.SetLease.
+func (p *Pipeline) SetTxOptions(options ...func(*tx.Tx)) {
+	p.txOptions = options
+}
+
+// newTx returns the Transaction of the Pipeline identified by txID, customized by the options of the Pipeline.
+func (p *Pipeline) newTx(ctx context.Context, txID string, options ...func(*tx.Tx)) tx.ReadyTx {
+	options = append(p.defaultTxOptions(), options...)
+	return tx.NewWithLogger(ctx, p.saga, p.storage, txID, p.saga.log, append(options, p.txOptions...)...)
+}
+
+// defaultTxOptions returns the options of every Transaction of the Pipeline. Only the Steps that have ended are
+// compensated, unless their definitions set the unfinished policy, as a failed Step is expected to have no effect.
+func (p *Pipeline) defaultTxOptions() []func(*tx.Tx) {
+	return []func(*tx.Tx){tx.SetSagaName(p.name), tx.SetUnfinishedPolicy(subtx.SkipUnfinished)}
+}
+
+// Run executes the Steps of the Pipeline in a new Transaction identified by txID. It starts the Transaction,
+// executes each Step once its dependencies are executed and ends the Transaction. If a Step fails, no more Steps
+// are started, and once the running Steps return the Transaction is recovered with tx.Recover, i.e. it's rolled
+// back until the rollback is successful or the context is cancelled, or if a pivot Step has ended, the failed Steps
+// are retried and the remaining Steps are executed.
+// If the txID is already committed, the Steps are not executed again and the Outcome has the logged results,
+// if it's in use otherwise, tx.ErrTxIDInUse is returned, see tx.IdempotentReused. If the Transaction is resumed
+// as per tx.ResumeReused policy, it's continued like with Resume.
+// The error is returned if the Transaction is not committed, the Outcome tells what happened in either case.
+func (p *Pipeline) Run(ctx context.Context, txID string, input ...interface{}) (Outcome, error) {
+	outcome := Outcome{TxID: txID, Results: map[string][]reflect.Value{}}
+	t := p.newTx(ctx, txID, tx.SetInput(input...))
+
+	if err := t.Start(); err != nil {
+		outcome.Status = NotStarted
+		return outcome, errors.Annotatef(err, "could not start pipeline: %s", p.name)
+	}
+
+	// the Transaction may be committed already, e.g. the Run is retried with the same txID, or resumed as per
+	// tx.ResumeReused policy, so the Steps executed already are restored from the logs and not executed again
+	restored, err := p.restore(txID, outcome.Results)
+	if err != nil {
+		outcome.Status = Incomplete
+		return outcome, errors.Annotatef(err, "could not restore pipeline: %s", p.name)
+	}
+
+	switch {
+	case t.State() == tx.Committed || restored.ended:
+		outcome.Status = Committed
+		return outcome, nil
+	case restored.aborted:
+		return p.recover(t, outcome, &stepResult{err: errors.New("transaction was aborted")})
+	}
+
+	return p.run(t, outcome, restored.input)
+}
+
+// Resume continues the Transaction of the Pipeline identified by txID, e.g. after the process restarts.
+// The input and the results of the executed Steps are restored from the logs, so the executed Steps are not
+// executed again. If the Transaction was being rolled back, the rollback is continued.
+func (p *Pipeline) Resume(ctx context.Context, txID string) (Outcome, error) {
+	outcome := Outcome{TxID: txID, Results: map[string][]reflect.Value{}}
+	t := p.newTx(ctx, txID)
+
+	if err := t.Resume(); err != nil {
+		outcome.Status = NotStarted
+		return outcome, errors.Annotatef(err, "could not resume pipeline: %s", p.name)
+	}
+
+	restored, err := p.restore(txID, outcome.Results)
+	if err != nil {
+		outcome.Status = NotStarted
+		return outcome, errors.Annotatef(err, "could not restore pipeline: %s", p.name)
+	}
+
+	switch {
+	case restored.ended:
+		outcome.Status = Committed
+		return outcome, nil
+	case restored.aborted:
+		return p.recover(t, outcome, &stepResult{err: errors.New("transaction was aborted")})
+	}
+
+	return p.run(t, outcome, restored.input)
+}
+
+// run executes the Steps that are not executed yet, and ends or rolls back the Transaction.
+func (p *Pipeline) run(t tx.ReadyTx, outcome Outcome, input []interface{}) (Outcome, error) {
+	if failed := p.execGraph(t, input, outcome.Results); failed != nil {
+		return p.recover(t, outcome, failed)
+	}
+
+	if err := t.End(); err != nil {
+		outcome.Status = Incomplete
+		return outcome, errors.Annotatef(err, "could not end pipeline: %s", p.name)
+	}
+
+	outcome.Status = Committed
+	return outcome, nil
+}
+
+// stepResult is the result of a Step executed in its own goroutine.
+type stepResult struct {
+	step       Step
+	res        []reflect.Value
+	err        error
+	unresolved bool // the arguments of the Step could not be resolved, so it's not executed
+}
+
+// execGraph executes the Steps in the Transaction, each Step in its own goroutine once its dependencies are executed.
+// The Steps that already have results are considered executed. It fills the results of the executed Steps,
+// and returns the result of the first Step that failed, or nil if all the Steps are executed.
+func (p *Pipeline) execGraph(t tx.ReadyTx, input []interface{}, results map[string][]reflect.Value) *stepResult {
+	pending, dependents, ready := p.graph()
+	done := make(chan stepResult)
+	running := 0
+	var failed *stepResult
+
+	executed := func(subTxID string) {
+		for _, next := range dependents[subTxID] {
+			pending[next.SubTxID]--
+			if pending[next.SubTxID] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	for {
+		for len(ready) > 0 && failed == nil {
+			node := ready[0]
+			ready = ready[1:]
+
+			if _, ok := results[node.SubTxID]; ok {
+				executed(node.SubTxID)
+				continue
+			}
+
+			args, err := p.resolveArgs(node.Step, input, results)
+			if err != nil {
+				failed = &stepResult{step: node.Step, err: err, unresolved: true}
+				break
+			}
+
+			running++
+			go func(step Step, args []interface{}) {
+				res, err := t.ExecSubTxAndGetResult(step.SubTxID, args...)
+				done <- stepResult{step: step, res: res, err: err}
+			}(node.Step, args)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-done
+		running--
+		if r.err != nil {
+			if failed == nil {
+				failed = &r
+			}
+			continue
+		}
+
+		results[r.step.SubTxID] = r.res[1:]
+		executed(r.step.SubTxID)
+	}
+
+	return failed
+}
+
+// resolveArgs resolves the arguments of the Step, if the Step has no Args the Pipeline input is returned.
+func (p *Pipeline) resolveArgs(step Step, input []interface{}, results map[string][]reflect.Value) ([]interface{}, error) {
+	if step.Args == nil {
+		return input, nil
+	}
+
+	args := make([]interface{}, 0, len(step.Args))
+	for i, arg := range step.Args {
+		value, err := arg.resolve(input, results)
+		if err != nil {
+			return nil, errors.Annotatef(err, "could not resolve argument: %d of step: %s", i, step.SubTxID)
+		}
+		args = append(args, value)
+	}
+
+	return args, nil
+}
+
+// restored is the state of a Pipeline Transaction restored from its logs.
+type restored struct {
+	input   []interface{}
+	ended   bool
+	aborted bool
+}
+
+// restore reads the logs of the Transaction, fills the results of the executed Steps and returns the restored state.
+func (p *Pipeline) restore(txID string, results map[string][]reflect.Value) (restored, error) {
+	var r restored
+	logs, err := p.storage.GetTxLogs(txID)
+	if err != nil {
+		return r, errors.Annotate(err, "could not get Tx logs from storage")
+	}
+
+	for _, logBytes := range logs {
+		var logData log.Log
+		if err := marshal.Unmarshal([]byte(logBytes), &logData); err != nil {
+			return r, errors.Annotate(err, "could not unmarshal log data")
+		}
+
+		switch logData.Type {
+		case log.StartTx:
+			// a reused TxID starts over
+			r = restored{}
+			for subTxID := range results {
+				delete(results, subTxID)
+			}
+			if logData.Name != p.name {
+				return r, errors.Errorf("transaction: %s belongs to saga type: %s", txID, logData.Name)
+			}
+			input, err := p.saga.UnmarshallArgs(logData.Args)
+			if err != nil {
+				return r, errors.Annotate(err, "could not unmarshall input")
+			}
+			r.input = make([]interface{}, 0, len(input))
+			for _, value := range input {
+				r.input = append(r.input, value.Interface())
+			}
+		case log.EndSubTx:
+			res, err := p.saga.UnmarshallArgs(logData.Results)
+			if err != nil {
+				return r, errors.Annotatef(err, "could not unmarshall results of subTxID: %s", logData.SubTxID)
+			}
+			results[logData.SubTxID] = res
+		case log.EndTx:
+			r.ended = true
+		case log.AbortTx:
+			r.aborted = true
+		}
+	}
+
+	return r, nil
+}
+
+// recover recovers the Transaction after the Step failed, see tx.Recover. If the Transaction is rolled back
+// the Outcome is RolledBack, if it's recovered forward the remaining Steps are executed.
+func (p *Pipeline) recover(t tx.ReadyTx, outcome Outcome, failed *stepResult) (Outcome, error) {
+	outcome.FailedStep = failed.step.SubTxID
+	mode, err := t.Recover()
+	if mode == tx.ForwardRecovery {
+		if err != nil {
+			outcome.Status = Incomplete
+			return outcome, errors.Annotatef(err, "could not recover pipeline: %s forward after step: %s failed with: %v", p.name, failed.step.SubTxID, failed.err)
+		}
+		if failed.unresolved {
+			outcome.Status = Incomplete
+			return outcome, errors.Annotatef(failed.err, "could not continue pipeline: %s after its pivot", p.name)
+		}
+
+		restored, err := p.restore(outcome.TxID, outcome.Results)
+		if err != nil {
+			outcome.Status = Incomplete
+			return outcome, errors.Annotatef(err, "could not restore pipeline: %s", p.name)
+		}
+		outcome.FailedStep = ""
+		return p.run(t, outcome, restored.input)
+	}
+
+	if err != nil {
+		outcome.Status = RollbackFailed
+		return outcome, errors.Annotatef(err, "could not rollback pipeline: %s after step: %s failed with: %v", p.name, failed.step.SubTxID, failed.err)
+	}
+
+	outcome.Status = RolledBack
+	return outcome, errors.Annotatef(failed.err, "pipeline: %s is rolled back", p.name)
+}
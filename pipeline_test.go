@@ -0,0 +1,360 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/retry"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestPipelineRunCommits(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transfer, err := sagaForTx.AddPipeline("transfer", memory.NewLogStorage(),
+		Step{SubTxID: "debit", Args: []Arg{Input(0), Input(1)}},
+		Step{SubTxID: "credit", Args: []Arg{Input(0), Value("pam")}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := transfer.Run(context.Background(), "pipeline-commit", 100, "sam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Status != Committed {
+		t.Fatalf("expected committed outcome, got: %+v", outcome)
+	}
+
+	expected := []string{"debit", "credit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestPipelineRunRollsBackOnFailure(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit")); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer, err := sagaForTx.AddPipeline("transfer", memory.NewLogStorage(),
+		Step{SubTxID: "debit"},
+		Step{SubTxID: "credit"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := transfer.Run(context.Background(), "pipeline-rollback", 100, "sam")
+	if err == nil {
+		t.Fatal("expected pipeline to fail")
+	}
+	if outcome.Status != RolledBack || outcome.FailedStep != "credit" {
+		t.Fatalf("expected rolled back outcome for credit, got: %+v", outcome)
+	}
+
+	// only the completed steps are compensated
+	expected := []string{"debit", "credit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestPipelineCompensatesFailedStepThatOptsIn(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit"),
+		subtx.SetUnfinishedPolicy(subtx.CompensateUnfinished)); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer, err := sagaForTx.AddPipeline("transfer", memory.NewLogStorage(),
+		Step{SubTxID: "debit"},
+		Step{SubTxID: "credit"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transfer.Run(context.Background(), "pipeline-opt-in", 100, "sam"); err == nil {
+		t.Fatal("expected pipeline to fail")
+	}
+	expected := []string{"debit", "credit", "compensate-credit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+// barrier returns an action that records the call and waits till the given number of barrier actions are running.
+func barrier(rec *recorder, parties int) func(string) func(context.Context, int, string) error {
+	var wg sync.WaitGroup
+	wg.Add(parties)
+	return func(name string) func(context.Context, int, string) error {
+		return func(c context.Context, amount int, account string) error {
+			rec.record(name)
+			wg.Done()
+			wg.Wait()
+			return nil
+		}
+	}
+}
+
+func TestGraphRunsIndependentStepsInParallel(t *testing.T) {
+	rec := &recorder{}
+	parallel := barrier(rec, 3)
+	sagaForTx := New()
+	for _, id := range []string{"reserve", "authorize", "allocate"} {
+		if err := sagaForTx.AddSubTx(id, parallel(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sagaForTx.AddSubTx("confirm", rec.failingAction("confirm"), rec.action("compensate-confirm")); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := sagaForTx.AddGraph("order", memory.NewLogStorage(),
+		Node{Step: Step{SubTxID: "reserve"}},
+		Node{Step: Step{SubTxID: "authorize"}},
+		Node{Step: Step{SubTxID: "allocate"}},
+		Node{Step: Step{SubTxID: "confirm"}, DependsOn: []string{"reserve", "authorize", "allocate"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := order.Run(context.Background(), "graph-rollback", 100, "sam")
+	if err == nil || outcome.Status != RolledBack || outcome.FailedStep != "confirm" {
+		t.Fatalf("expected graph to roll back after confirm failed, got: %+v, %v", outcome, err)
+	}
+
+	// the parallel steps are compensated in the reverse order of their execution, the failed confirm is skipped
+	started := rec.calls[:3]
+	expected := []string{"compensate-" + started[2], "compensate-" + started[1], "compensate-" + started[0]}
+	if !reflect.DeepEqual(rec.calls[4:], expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls[4:])
+	}
+}
+
+func TestGraphRejectsCyclicDependencies(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := sagaForTx.AddGraph("cyclic", memory.NewLogStorage(),
+		Node{Step: Step{SubTxID: "debit"}, DependsOn: []string{"credit"}},
+		Node{Step: Step{SubTxID: "credit"}, DependsOn: []string{"debit"}},
+	)
+	if err == nil {
+		t.Fatal("expected error for cyclic dependencies")
+	}
+}
+
+func TestPipelinePassesResultsAndResumesFromLogs(t *testing.T) {
+	var cancelled, shipped []string
+	crash := true
+	reserve := func(c context.Context, item string) (error, string) {
+		return nil, "reservation-of-" + item
+	}
+	cancel := func(c context.Context, item string) error {
+		return nil
+	}
+	ship := func(c context.Context, reservationID string, address string) error {
+		if crash {
+			crash = false
+			panic("worker died")
+		}
+		shipped = append(shipped, reservationID+" to "+address)
+		return nil
+	}
+	unship := func(c context.Context, reservationID string, address string) error {
+		cancelled = append(cancelled, reservationID)
+		return nil
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", reserve, cancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("ship", ship, unship, subtx.SetUnfinishedPolicy(subtx.SkipUnfinished)); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	order, err := sagaForTx.AddPipeline("order", storage,
+		Step{SubTxID: "reserve", Args: []Arg{Input(0)}},
+		Step{SubTxID: "ship", Args: []Arg{Result("reserve", 0), Input(1)}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate the crash by starting the pipeline transaction and executing the first step only
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "resumed-order",
+		tx.SetSagaName("order"), tx.SetInput("book", "baker street"))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("reserve", "book"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("ship", "reservation-of-book", "baker street"); err == nil {
+		t.Fatal("expected the ship step to crash")
+	}
+
+	outcome, err := order.Resume(context.Background(), "resumed-order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Status != Committed {
+		t.Fatalf("expected committed outcome, got: %+v", outcome)
+	}
+
+	expected := []string{"reservation-of-book to baker street"}
+	if !reflect.DeepEqual(shipped, expected) {
+		t.Fatalf("expected shipments: %v, got: %v", expected, shipped)
+	}
+	if len(cancelled) != 0 {
+		t.Fatalf("expected no compensations, got: %v", cancelled)
+	}
+}
+
+func TestPipelineRejectsResultOfIndependentStep(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := sagaForTx.AddGraph("independent", memory.NewLogStorage(),
+		Node{Step: Step{SubTxID: "debit"}},
+		Node{Step: Step{SubTxID: "credit", Args: []Arg{Result("debit", 0)}}},
+	)
+	if err == nil {
+		t.Fatal("expected error for result of a step that's not a dependency")
+	}
+}
+
+func TestPipelineRejectsResultThatCanNotBeLogged(t *testing.T) {
+	open := func(c context.Context, item string) (error, string, chan int) {
+		return nil, "stream-of-" + item, make(chan int)
+	}
+	noop := func(c context.Context, s string) error { return nil }
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("open", open, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("read", noop, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	// the results of open can't be logged, so the stream would not be restored on resume
+	_, err := sagaForTx.AddPipeline("stream", memory.NewLogStorage(),
+		Step{SubTxID: "open", Args: []Arg{Input(0)}},
+		Step{SubTxID: "read", Args: []Arg{Result("open", 0)}},
+	)
+	if err == nil {
+		t.Fatal("expected error for result of a step whose results can't be logged")
+	}
+}
+
+func TestPipelineRecoversForwardAfterPivot(t *testing.T) {
+	rec := &recorder{}
+	fastRetry := retry.Policy{MaxAttempts: 1, Backoff: retry.Backoff{InitialInterval: time.Millisecond}}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", rec.action("reserve"), rec.action("compensate-reserve")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("capture", rec.action("capture"), rec.action("compensate-capture"),
+		subtx.SetKind(subtx.Pivot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("ship", flaky(2, errTransient), rec.action("compensate-ship"),
+		subtx.SetKind(subtx.Retriable), subtx.SetRetryPolicy(fastRetry)); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := sagaForTx.AddPipeline("order", memory.NewLogStorage(),
+		Step{SubTxID: "reserve"}, Step{SubTxID: "capture"}, Step{SubTxID: "ship"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := order.Run(context.Background(), "pivoted-order", 100, "sam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Status != Committed {
+		t.Fatalf("expected committed outcome, got: %+v", outcome)
+	}
+}
+
+func TestRollbackIsRefusedAfterPivot(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", rec.action("reserve"), rec.action("compensate-reserve")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("capture", rec.failingAction("capture"), rec.action("compensate-capture"),
+		subtx.SetKind(subtx.Pivot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("capture-ok", rec.action("capture-ok"), rec.action("compensate-capture-ok"),
+		subtx.SetKind(subtx.Pivot)); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed pivot: rolled back without compensating the pivot
+	failedTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "failed-pivot")
+	if err := failedTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = failedTx.ExecSubTx("reserve", 100, "sam")
+	_ = failedTx.ExecSubTx("capture", 100, "sam")
+	rec.calls = nil
+	if mode, err := failedTx.Recover(); err != nil || mode != tx.BackwardRecovery {
+		t.Fatalf("expected backward recovery, got: %v, %v", mode, err)
+	}
+	if expected := []string{"compensate-reserve"}; !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls)
+	}
+
+	// passed pivot: can't be rolled back
+	pivotedTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "passed-pivot")
+	if err := pivotedTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = pivotedTx.ExecSubTx("reserve", 100, "sam")
+	_ = pivotedTx.ExecSubTx("capture-ok", 100, "sam")
+	if err := pivotedTx.Rollback(3); errors.Cause(err) != tx.ErrPivotPassed {
+		t.Fatalf("expected ErrPivotPassed, got: %v", err)
+	}
+}
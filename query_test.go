@@ -0,0 +1,81 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestQueryTxIDsFiltersAndPaginates(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	var queryable tx.QueryableStorage = storage
+	started := time.Now()
+	for _, id := range []string{"tx-1", "tx-2", "tx-3", "tx-4"} {
+		readyTx := tx.New(context.Background(), sagaForTx, storage, id)
+		if err := readyTx.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+		if id == "tx-2" || id == "tx-4" {
+			if err := readyTx.End(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	page, err := queryable.QueryTxIDs(tx.Query{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, tx.Page{TxIDs: []string{"tx-1", "tx-2", "tx-3"}, Next: "tx-3"}) {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page, err = queryable.QueryTxIDs(tx.Query{Limit: 3, After: page.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page, tx.Page{TxIDs: []string{"tx-4"}}) {
+		t.Fatalf("unexpected last page: %+v", page)
+	}
+
+	page, err = queryable.QueryTxIDs(tx.Query{States: []tx.State{tx.Committed}, StartedAfter: started.Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.TxIDs, []string{"tx-2", "tx-4"}) {
+		t.Fatalf("expected committed transactions, got: %+v", page)
+	}
+	page, err = queryable.QueryTxIDs(tx.Query{StartedBefore: started.Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.TxIDs) != 0 {
+		t.Fatalf("expected no transactions started before, got: %+v", page)
+	}
+
+	last, err := queryable.GetLastLog("tx-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l log.Log
+	if err := marshal.Unmarshal([]byte(last), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Type != log.EndTx {
+		t.Fatalf("expected end of transaction as the last log, got: %+v", l)
+	}
+}
@@ -0,0 +1,85 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestReadOnlySubTxsAreSkippedOnRollback(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("lookup", rec.action("lookup"), nil, subtx.SetKind(subtx.ReadOnly)); err != nil {
+		t.Fatal(err)
+	}
+	// the compensate of a ReadOnly SubTx is never called
+	if err := sagaForTx.AddSubTx("notify", rec.action("notify"), rec.action("compensate-notify"),
+		subtx.SetKind(subtx.ReadOnly)); err != nil {
+		t.Fatal(err)
+	}
+	type lookupInput struct{ Account string }
+	typed, err := AddTypedSubTx[lookupInput, int](sagaForTx, "typed-lookup",
+		func(ctx context.Context, in lookupInput) (error, int) {
+			rec.record("typed-lookup")
+			return nil, 100
+		}, nil, subtx.SetKind(subtx.ReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, st, "read-only")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"debit", "lookup", "notify"} {
+		if err := readyTx.ExecSubTx(id, 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := typed.Exec(readyTx, lookupInput{Account: "sam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"debit", "lookup", "notify", "typed-lookup", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("unexpected calls: %v", rec.calls)
+	}
+
+	// the ReadOnly SubTxs are logged for audit
+	status, err := readyTx.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Aborted || len(status.Steps) != 4 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestNilCompensateIsRejectedForMutatingSubTxs(t *testing.T) {
+	rec := &recorder{}
+	s := New()
+	if err := s.AddSubTx("debit", rec.action("debit"), nil); err == nil {
+		t.Fatal("expected nil compensate of Compensatable SubTx to be rejected")
+	}
+	if err := s.AddSubTx("debit", rec.action("debit"), nil, subtx.SetKind(subtx.Retriable)); err == nil {
+		t.Fatal("expected nil compensate of Retriable SubTx to be rejected")
+	}
+	if err := s.AddSubTx("debit", rec.action("debit"), nil, subtx.SetKind(subtx.ReadOnly),
+		subtx.SetCompensateWithResults()); err == nil {
+		t.Fatal("expected compensate with results without compensate to be rejected")
+	}
+	if err := s.AddSubTx("charge", rec.action("charge"), nil, subtx.SetKind(subtx.Pivot)); err != nil {
+		t.Fatalf("expected nil compensate of Pivot SubTx to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package saga
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/tx"
+)
+
+// RecoveryPolicy tells the Coordinator what to do with an incomplete Transaction.
+type RecoveryPolicy int
+
+const (
+	// RollbackIncomplete recovers the incomplete Transaction with tx.RecoverWithStrategy, i.e. it's rolled back,
+	// or if a pivot SubTx has ended, its unfinished SubTxs are retried.
+	RollbackIncomplete RecoveryPolicy = iota + 1
+
+	// ResumeIncomplete resumes the incomplete Transaction with the Pipeline of its saga type, see Pipeline.Resume.
+	// The Transactions without a Pipeline can't be resumed, so they're recovered as with RollbackIncomplete.
+	ResumeIncomplete
+
+	// ReportIncomplete only reports the incomplete Transaction.
+	ReportIncomplete
+)
+
+// RecoveryAction is what the Coordinator did with an incomplete Transaction.
+type RecoveryAction int
+
+const (
+	// ReportedTx denotes that the Transaction is only reported, e.g. as per ReportIncomplete policy,
+	// or because its rollback was given up before, see tx.CompensationFailed.
+	ReportedTx RecoveryAction = iota + 1
+
+	// RolledBackTx denotes that the Transaction is rolled back.
+	RolledBackTx
+
+	// RecoveredForwardTx denotes that the unfinished SubTxs after the pivot are retried,
+	// the remaining SubTxs of the Transaction must still be executed.
+	RecoveredForwardTx
+
+	// ResumedTx denotes that the Transaction is resumed with its Pipeline.
+	ResumedTx
+)
+
+// RecoveryReport tells what the Coordinator did with an incomplete Transaction.
+type RecoveryReport struct {
+	TxID   string
+	Name   string   // Name is the saga type of the Transaction.
+	State  tx.State // State is the state of the Transaction before the recovery.
+	Action RecoveryAction
+	Err    error // Err is the error of the recovery, if any.
+}
+
+// Coordinator finds the incomplete Transactions in a Storage, i.e. the ones started but not ended, or aborted but
+// not rolled back, and recovers them as per its RecoveryPolicy using the SubTxs and Pipelines of the Saga.
+// Run it once when the process starts with RecoverOnce, or periodically with Run.
+type Coordinator struct {
+	saga     *Saga
+	storage  tx.Storage
+	lister   tx.TxLister
+	policy   RecoveryPolicy
+	strategy tx.RollbackStrategy
+	interval time.Duration
+	minAge   time.Duration
+	report   func(RecoveryReport)
+
+	txOptions []func(*tx.Tx) // txOptions customize the Transactions recovered, e.g. to recover them under a lease.
+	leased    bool           // leased tells if the Transactions are recovered under the lease, see SetRecoveryLease.
+}
+
+// defaultRecoveryMinAge is the min age of the Transactions recovered by the Coordinator, unless it's set.
+const defaultRecoveryMinAge = 5 * time.Minute
+
+// defaultRecoveryOwner and defaultRecoveryLeaseTTL are the lease of the Coordinator on a tx.Leaser storage, unless
+// it's set with SetRecoveryLease.
+const (
+	defaultRecoveryOwner    = "saga-coordinator"
+	defaultRecoveryLeaseTTL = time.Minute
+)
+
+// NewCoordinator returns the Coordinator that recovers the Transactions of the saga kept in given storage, the storage
+// must implement tx.TxLister. It accepts functional options to customize the Coordinator e.g. SetRecoveryPolicy.
+// By default, the incomplete Transactions are recovered with RollbackIncomplete policy, the rollback is retried
+// 5 times with the default backoff, and Run looks for the incomplete Transactions every minute. The Transactions
+// updated within the last 5 minutes are skipped by default, so that the ones still driven by their owners are not
+// rolled back, see SetRecoveryMinAge. If the storage implements tx.Leaser, the Transactions are recovered under
+// the lease by default, so the ones whose lease is held by their owners are reported with tx.ErrLeaseHeld.
+func (s *Saga) NewCoordinator(st tx.Storage, options ...func(*Coordinator) error) (*Coordinator, error) {
+	lister, ok := st.(tx.TxLister)
+	if !ok {
+		return nil, errors.New("storage can not list transactions, it must implement tx.TxLister")
+	}
+
+	strategy := tx.DefaultRollbackStrategy()
+	strategy.MaxAttempts = 5
+	c := &Coordinator{
+		saga:     s,
+		storage:  st,
+		lister:   lister,
+		policy:   RollbackIncomplete,
+		strategy: strategy,
+		interval: time.Minute,
+		minAge:   defaultRecoveryMinAge,
+	}
+	for _, setter := range options {
+		if err := setter(c); err != nil {
+			return nil, errors.Annotate(err, "issue while setting options")
+		}
+	}
+	if _, ok := st.(tx.Leaser); ok && !c.leased {
+		c.txOptions = append(c.txOptions, tx.SetLease(defaultRecoveryOwner, defaultRecoveryLeaseTTL))
+		c.leased = true
+	}
+
+	return c, nil
+}
+
+// SetRecoveryPolicy is the functional option to set the RecoveryPolicy of the Coordinator.
+func SetRecoveryPolicy(p RecoveryPolicy) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		if p < RollbackIncomplete || p > ReportIncomplete {
+			return errors.Errorf("unknown recovery policy: %d", p)
+		}
+		c.policy = p
+		return nil
+	}
+}
+
+// SetRecoveryStrategy is the functional option to set the strategy for rolling back the incomplete Transactions.
+func SetRecoveryStrategy(strategy tx.RollbackStrategy) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		c.strategy = strategy
+		return nil
+	}
+}
+
+// SetRecoveryInterval is the functional option to set the interval at which Run looks for the incomplete Transactions.
+func SetRecoveryInterval(d time.Duration) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		if d <= 0 {
+			return errors.New("recovery interval must be greater than 0")
+		}
+		c.interval = d
+		return nil
+	}
+}
+
+// SetRecoveryMinAge is the functional option to skip the Transactions that were updated within given duration.
+// It's 5 minutes by default, so that the running Transactions are not taken for incomplete ones. Set it longer than
+// the time the Transactions may take between two SubTxs, or set it to 0 when no process executes the Transactions,
+// e.g. to recover them all when the only process restarts.
+func SetRecoveryMinAge(d time.Duration) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		if d < 0 {
+			return errors.New("recovery min age must not be negative")
+		}
+		c.minAge = d
+		return nil
+	}
+}
+
+// SetRecoveryLease is the functional option to recover the Transactions under the lease of the storage, so that
+// the Transactions driven by their owners are not recovered at the same time. See tx.SetLease.
+// The Transactions whose lease is held by another owner are reported with tx.ErrLeaseHeld.
+func SetRecoveryLease(owner string, ttl time.Duration) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		if _, ok := c.storage.(tx.Leaser); !ok {
+			return errors.New("storage can not grant leases, it must implement tx.Leaser")
+		}
+		if owner == "" || ttl <= 0 {
+			return errors.New("lease needs an owner and a ttl greater than 0")
+		}
+		c.txOptions = append(c.txOptions, tx.SetLease(owner, ttl))
+		c.leased = true
+		return nil
+	}
+}
+
+// SetRecoveryReporter is the functional option to set the function that's called with the report of every
+// incomplete Transaction found by the Coordinator.
+func SetRecoveryReporter(report func(RecoveryReport)) func(*Coordinator) error {
+	return func(c *Coordinator) error {
+		c.report = report
+		return nil
+	}
+}
+
+// RecoverOnce recovers the incomplete Transactions in the storage and returns a report for each of them.
+// The failure of recovering a Transaction is in its report, the error is returned if the Transactions
+// could not be listed or the context is cancelled.
+func (c *Coordinator) RecoverOnce(ctx context.Context) ([]RecoveryReport, error) {
+	ids, err := c.lister.ListTxIDs()
+	if err != nil {
+		return nil, errors.Annotate(err, "could not list transactions")
+	}
+
+	var reports []RecoveryReport
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return reports, errors.Annotate(err, "recovery is cancelled")
+		}
+
+		status, err := tx.New(ctx, c.saga, c.storage, id).Status()
+		if err != nil {
+			reports = append(reports, c.reported(RecoveryReport{TxID: id, Action: ReportedTx, Err: err}))
+			continue
+		}
+		if !c.isIncomplete(status) {
+			continue
+		}
+
+		reports = append(reports, c.reported(c.recover(ctx, status)))
+	}
+
+	return reports, nil
+}
+
+// Run recovers the incomplete Transactions in the storage right away, and then at every interval until the context
+// is cancelled. The errors are logged, and the reports are passed to the reporter set with SetRecoveryReporter.
+func (c *Coordinator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.RecoverOnce(ctx); err != nil {
+			c.saga.log.Error("could not recover transactions: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Annotate(ctx.Err(), "recovery is stopped")
+		case <-ticker.C:
+		}
+	}
+}
+
+// isIncomplete tells if the Transaction needs recovery. The Transaction that passed its deadline needs it right away
+// when it's recovered under the lease, as the lease fences its owner. Otherwise, its owner may still be executing
+// a SubTx, so it's given the min age after the deadline.
+func (c *Coordinator) isIncomplete(status tx.Status) bool {
+	if tx.IsExpired(status) {
+		return c.leased || time.Since(status.Deadline) >= c.minAge
+	}
+
+	switch status.State {
+	case tx.Running, tx.Aborting, tx.CompensationFailed:
+		return time.Since(status.UpdatedAt) >= c.minAge
+	default:
+		return false
+	}
+}
+
+// recover recovers the incomplete Transaction as per the policy.
+func (c *Coordinator) recover(ctx context.Context, status tx.Status) RecoveryReport {
+	report := RecoveryReport{TxID: status.TxID, Name: status.Name, State: status.State, Action: ReportedTx}
+	if c.policy == ReportIncomplete || status.State == tx.CompensationFailed {
+		return report
+	}
+
+	if c.policy == ResumeIncomplete {
+		if p, err := c.saga.GetPipeline(status.Name); err == nil {
+			// the Pipeline is resumed from the storage of the Coordinator
+			resumable := *p
+			resumable.storage = c.storage
+			resumable.txOptions = append(append([]func(*tx.Tx){}, p.txOptions...), c.txOptions...)
+			report.Action = ResumedTx
+			_, report.Err = resumable.Resume(ctx, status.TxID)
+			return report
+		}
+	}
+
+	// the Transaction of a Pipeline is rolled back the way the Pipeline rolls it back
+	options := []func(*tx.Tx){tx.SetSagaName(status.Name)}
+	if p, err := c.saga.GetPipeline(status.Name); err == nil {
+		options = p.defaultTxOptions()
+	}
+	options = append(options, c.txOptions...)
+	t := tx.NewWithLogger(ctx, c.saga, c.storage, status.TxID, c.saga.log, options...)
+	if err := t.Resume(); err != nil {
+		report.Err = errors.Annotatef(err, "could not resume TxID: %s", status.TxID)
+		return report
+	}
+
+	mode, err := t.RecoverWithStrategy(c.strategy)
+	switch mode {
+	case tx.BackwardRecovery:
+		report.Action = RolledBackTx
+	case tx.ForwardRecovery:
+		report.Action = RecoveredForwardTx
+	}
+	if err != nil {
+		report.Err = errors.Annotatef(err, "could not recover TxID: %s", status.TxID)
+	}
+	if err := t.ReleaseLease(); err != nil && report.Err == nil {
+		report.Err = err
+	}
+
+	return report
+}
+
+// reported passes the report to the reporter, if any, and returns it.
+func (c *Coordinator) reported(report RecoveryReport) RecoveryReport {
+	if c.report != nil {
+		c.report(report)
+	}
+	return report
+}
@@ -0,0 +1,126 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestCoordinatorRollsBackIncompleteTransactions(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	committed := tx.New(context.Background(), sagaForTx, storage, "committed")
+	if err := committed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process dies before the transaction is ended
+	crashed := tx.New(context.Background(), sagaForTx, storage, "crashed")
+	if err := crashed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.ExecSubTx("debit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	rec.calls = nil
+
+	// the recently updated transaction may still be driven by its owner, so it's skipped by default
+	coordinator, err := sagaForTx.NewCoordinator(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports, err := coordinator.RecoverOnce(context.Background()); err != nil || len(reports) != 0 {
+		t.Fatalf("expected no reports, got: %+v, error: %v", reports, err)
+	}
+
+	coordinator, err = sagaForTx.NewCoordinator(storage, SetRecoveryMinAge(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := coordinator.RecoverOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 1 || reports[0].TxID != "crashed" || reports[0].State != tx.Running ||
+		reports[0].Action != RolledBackTx || reports[0].Err != nil {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	expected := []string{"compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+
+	// the rolled back transaction is complete
+	if reports, err = coordinator.RecoverOnce(context.Background()); err != nil || len(reports) != 0 {
+		t.Fatalf("expected no reports, got: %+v, %v", reports, err)
+	}
+}
+
+func TestCoordinatorResumesPipeline(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	if _, err := sagaForTx.AddPipeline("transfer", storage, Step{SubTxID: "debit"}, Step{SubTxID: "credit"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process dies after the first step of the pipeline
+	crashed := tx.New(context.Background(), sagaForTx, storage, "crashed-pipeline",
+		tx.SetSagaName("transfer"), tx.SetInput(100, "sam"))
+	if err := crashed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	rec.calls = nil
+
+	var reported []RecoveryReport
+	coordinator, err := sagaForTx.NewCoordinator(storage, SetRecoveryPolicy(ResumeIncomplete), SetRecoveryMinAge(0),
+		SetRecoveryReporter(func(r RecoveryReport) { reported = append(reported, r) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coordinator.RecoverOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reported) != 1 || reported[0].Action != ResumedTx || reported[0].Err != nil {
+		t.Fatalf("unexpected reports: %+v", reported)
+	}
+	expected := []string{"credit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+
+	status, err := tx.New(context.Background(), sagaForTx, storage, "crashed-pipeline").Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Committed {
+		t.Fatalf("expected committed transaction, got: %s", status.State)
+	}
+}
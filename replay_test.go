@@ -0,0 +1,148 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestReplayReturnsRecordedResults(t *testing.T) {
+	rec := &recorder{}
+	reserve := func(c context.Context, item string) (error, string) {
+		rec.record("reserve")
+		return nil, "reservation-of-" + item
+	}
+	chargeFails := true
+	charge := func(c context.Context, reservationID string) error {
+		rec.record("charge-" + reservationID)
+		if chargeFails {
+			return errors.New("charge failed")
+		}
+		return nil
+	}
+	noop := func(c context.Context, s string) error { return nil }
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", reserve, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("charge", charge, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	// handler is re-run by the worker with the same txID
+	storage := memory.NewLogStorage()
+	handler := func() error {
+		readyTx := tx.New(context.Background(), sagaForTx, storage, "order-1", tx.SetReplay(), tx.SetReusePolicy(tx.ResumeReused))
+		if err := readyTx.Start(); err != nil {
+			return err
+		}
+		res, err := readyTx.ExecSubTxAndGetResult("reserve", "book")
+		if err != nil {
+			return err
+		}
+		if err := readyTx.ExecSubTx("charge", res[1].String()); err != nil {
+			return err
+		}
+		return readyTx.End()
+	}
+
+	if err := handler(); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	chargeFails = false
+	if err := handler(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"reserve", "charge-reservation-of-book", "charge-reservation-of-book"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+
+	status, err := tx.New(context.Background(), sagaForTx, storage, "order-1").Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Committed || len(status.Steps) != 2 || status.Steps[1].Attempt != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestReplayRejectsMismatchedSubTx(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "mismatch")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := tx.New(context.Background(), sagaForTx, storage, "mismatch", tx.SetReplay())
+	if err := replayed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayed.ExecSubTx("debit", 200, "sam"); jujuerrors.Cause(err) != tx.ErrReplayMismatch {
+		t.Fatalf("expected ErrReplayMismatch, got: %v", err)
+	}
+}
+
+func TestReplayStartsFromTheLastStart(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first run is rolled back when the TxID is reused, and the second run crashes after debit
+	storage := memory.NewLogStorage()
+	for _, options := range [][]func(*tx.Tx){nil, {tx.SetReusePolicy(tx.RollbackReused)}} {
+		readyTx := tx.New(context.Background(), sagaForTx, storage, "restarted", options...)
+		if err := readyTx.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.calls = nil
+
+	replayed := tx.New(context.Background(), sagaForTx, storage, "restarted", tx.SetReplay())
+	if err := replayed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayed.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayed.ExecSubTx("credit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"credit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+	status, err := replayed.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Steps) != 3 || status.Steps[2].SubTxID != "credit" || status.Steps[2].Seq != 3 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
@@ -0,0 +1,80 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing delays between the retries of an operation, randomized with jitter.
+type Backoff struct {
+	// InitialInterval is the delay before the first retry.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay between retries. 0 means no cap, other than the longest Duration.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor by which the delay grows after each retry. Values less than 1 keep the delay constant.
+	Multiplier float64
+
+	// Jitter randomizes the delay by the given fraction, e.g. 0.2 gives a delay between 80% and 120% of the computed delay.
+	Jitter float64
+}
+
+// DefaultBackoff returns the Backoff that starts with 100ms delay and doubles it up to 30s, with 20% jitter.
+func DefaultBackoff() Backoff {
+	return Backoff{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+}
+
+// Delay returns the delay before the given retry, the first retry is 1.
+func (b Backoff) Delay(retry int) time.Duration {
+	if retry < 1 {
+		retry = 1
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(b.InitialInterval) * math.Pow(multiplier, float64(retry-1))
+	if b.MaxInterval > 0 && delay > float64(b.MaxInterval) {
+		delay = float64(b.MaxInterval)
+	}
+
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	// the delay without cap overflows the Duration after enough retries
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// Policy decides whether and when a failed operation is retried.
+// The zero value of Policy makes a single attempt.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts including the first one. Values less than 1 mean a single attempt.
+	MaxAttempts int
+
+	// Backoff computes the delay before each retry.
+	Backoff Backoff
+
+	// Retryable classifies the errors that are worth a retry. nil means every error is retryable.
+	Retryable func(error) bool
+}
+
+// ShouldRetry tells if the operation must be retried after the given attempt failed with the error, the first attempt is 1.
+func (p Policy) ShouldRetry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
@@ -0,0 +1,132 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/retry"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+var errTransient = errors.New("network blip")
+
+// flaky fails with the error for the given number of calls and succeeds after that.
+func flaky(failures int, err error) func(context.Context, int, string) error {
+	return func(c context.Context, amount int, to string) error {
+		if failures > 0 {
+			failures--
+			return err
+		}
+		return nil
+	}
+}
+
+func TestActionIsRetriedAsPerRetryPolicy(t *testing.T) {
+	rec := &recorder{}
+	policy := retry.Policy{
+		MaxAttempts: 3,
+		Backoff:     retry.Backoff{InitialInterval: time.Millisecond, Multiplier: 2, Jitter: 0.1},
+		Retryable:   func(err error) bool { return err == errTransient },
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("credit", flaky(2, errTransient), rec.action("compensate-credit"),
+		subtx.SetRetryPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("debit", flaky(1, errors.New("account closed")), rec.action("compensate-debit"),
+		subtx.SetRetryPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "retried-action")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("credit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err == nil {
+		t.Fatal("expected non-retryable error not to be retried")
+	}
+
+	var attempts []log.Type
+	for _, l := range getLogs(t, storage, "retried-action") {
+		if l.SubTxID == "credit" && l.Attempt > 0 {
+			attempts = append(attempts, l.Type)
+		}
+	}
+	expected := []log.Type{log.StartSubTx, log.FailSubTx, log.StartSubTx, log.FailSubTx, log.StartSubTx, log.EndSubTx}
+	if !reflect.DeepEqual(attempts, expected) {
+		t.Fatalf("expected logs: %v, got: %v", expected, attempts)
+	}
+}
+
+func TestBackoffWithoutCapDoesNotOverflow(t *testing.T) {
+	backoff := retry.Backoff{InitialInterval: 100 * time.Millisecond, Multiplier: 2, Jitter: 0.2}
+	previous := time.Duration(0)
+	for attempt := 1; attempt <= 200; attempt++ {
+		delay := backoff.Delay(attempt)
+		if delay <= 0 {
+			t.Fatalf("expected positive delay for retry: %d, got: %s", attempt, delay)
+		}
+		if attempt > 100 && delay < previous {
+			t.Fatalf("expected the delay to stay at the longest Duration, got: %s after %s", delay, previous)
+		}
+		previous = delay
+	}
+}
+
+func TestRetriableIsRetriedUntilSuccessOnlyAfterPivot(t *testing.T) {
+	rec := &recorder{}
+	policy := retry.Policy{
+		MaxAttempts: 2,
+		Backoff:     retry.Backoff{InitialInterval: time.Millisecond, Multiplier: 1},
+		Retryable:   func(err error) bool { return err == errTransient },
+	}
+	panicking := func(c context.Context, amount int, to string) error {
+		panic("bug")
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("charge", rec.action("charge"), rec.action("refund"), subtx.SetKind(subtx.Pivot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("ship", flaky(5, errTransient), rec.action("unship"),
+		subtx.SetKind(subtx.Retriable), subtx.SetRetryPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("notify", panicking, rec.action("unnotify"),
+		subtx.SetKind(subtx.Retriable), subtx.SetRetryPolicy(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	// before the pivot, the retry policy applies
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "retriable")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("ship", 100, "pam"); err == nil {
+		t.Fatal("expected the retriable step to fail before the pivot")
+	}
+
+	// after the pivot, the retryable errors are retried until success, the others are not
+	if err := readyTx.ExecSubTx("charge", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("ship", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	err := readyTx.ExecSubTx("notify", 100, "pam")
+	if _, ok := jujuerrors.Cause(err).(*tx.PanicError); !ok {
+		t.Fatalf("expected PanicError, got: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestStartTreatsCommittedTxIDAsIdempotentSuccess(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	for _, id := range []string{"committed", "running"} {
+		readyTx := tx.New(context.Background(), sagaForTx, storage, id)
+		if err := readyTx.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+		if id == "committed" {
+			if err := readyTx.End(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rec.calls = nil
+
+	retried := tx.New(context.Background(), sagaForTx, storage, "committed")
+	if err := retried.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if retried.State() != tx.Committed {
+		t.Fatalf("expected committed transaction, got: %s", retried.State())
+	}
+
+	err := tx.New(context.Background(), sagaForTx, storage, "running").Start()
+	if jujuerrors.Cause(err) != tx.ErrTxIDInUse {
+		t.Fatalf("expected ErrTxIDInUse, got: %v", err)
+	}
+	if len(rec.calls) != 0 {
+		t.Fatalf("expected no calls, got: %v", rec.calls)
+	}
+}
+
+func TestStartAppliesReusePolicy(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "reused")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	rec.calls = nil
+
+	err := tx.New(context.Background(), sagaForTx, storage, "reused", tx.SetReusePolicy(tx.RejectReused)).Start()
+	if jujuerrors.Cause(err) != tx.ErrTxIDInUse {
+		t.Fatalf("expected ErrTxIDInUse, got: %v", err)
+	}
+
+	resumed := tx.New(context.Background(), sagaForTx, storage, "reused", tx.SetReusePolicy(tx.ResumeReused))
+	if err := resumed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.ExecSubTx("credit", 100, "pam"); err != nil {
+		t.Fatal(err)
+	}
+	status, err := resumed.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Steps) != 2 || status.Steps[1].Seq != 2 {
+		t.Fatalf("expected resumed transaction to continue the steps, got: %+v", status.Steps)
+	}
+
+	restarted := tx.New(context.Background(), sagaForTx, storage, "reused", tx.SetReusePolicy(tx.RollbackReused))
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"credit", "compensate-credit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+	if restarted.State() != tx.Running {
+		t.Fatalf("expected restarted transaction to be running, got: %s", restarted.State())
+	}
+
+	// the committed Transaction is rolled back too
+	if err := restarted.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.End(); err != nil {
+		t.Fatal(err)
+	}
+	rec.calls = nil
+	if err := tx.New(context.Background(), sagaForTx, storage, "reused", tx.SetReusePolicy(tx.RollbackReused)).Start(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"compensate-debit"}; !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestPipelineRunIsIdempotentForCommittedTxID(t *testing.T) {
+	reserve := func(c context.Context, item string) (error, string) {
+		return nil, "reservation-of-" + item
+	}
+	calls := 0
+	counted := func(c context.Context, item string) (error, string) {
+		calls++
+		return reserve(c, item)
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", counted, func(c context.Context, item string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := sagaForTx.AddPipeline("reservation", memory.NewLogStorage(), Step{SubTxID: "reserve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		outcome, err := pipeline.Run(context.Background(), "reservation-1", "book")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome.Status != Committed || outcome.Results["reserve"][0].String() != "reservation-of-book" {
+			t.Fatalf("unexpected outcome: %+v", outcome)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected reserve to be called once, got: %d", calls)
+	}
+}
+
+func TestPipelineRunResumesReusedTxID(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := memory.NewLogStorage()
+	transfer, err := sagaForTx.AddPipeline("transfer", storage,
+		Step{SubTxID: "debit"},
+		Step{SubTxID: "credit"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer.SetTxOptions(tx.SetReusePolicy(tx.ResumeReused))
+
+	// simulate the crash after the debit
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "resumed-transfer",
+		tx.SetSagaName("transfer"), tx.SetInput(100, "sam"))
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, err := transfer.Run(context.Background(), "resumed-transfer", 100, "sam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.Status != Committed {
+		t.Fatalf("expected committed outcome, got: %+v", outcome)
+	}
+	if expected := []string{"debit", "credit"}; !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
@@ -0,0 +1,400 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/retry"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+// recorder records the calls made to actions and compensations in the order they're made.
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, name)
+}
+
+func (r *recorder) action(name string) func(context.Context, int, string) error {
+	return func(c context.Context, amount int, account string) error {
+		r.record(name)
+		return nil
+	}
+}
+
+func (r *recorder) failingAction(name string) func(context.Context, int, string) error {
+	return func(c context.Context, amount int, account string) error {
+		r.record(name)
+		return errors.New(name + " failed")
+	}
+}
+
+// failingOnce fails the first call and records the calls after that.
+func (r *recorder) failingOnce(name string) func(context.Context, int, string) error {
+	failed := false
+	return func(c context.Context, amount int, account string) error {
+		if !failed {
+			failed = true
+			return errors.New(name + " failed")
+		}
+		r.record(name)
+		return nil
+	}
+}
+
+func TestRollbackCompensatesInReverseOrder(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"reserve", "debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "reverse-order")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"reserve", "debit", "credit"} {
+		if err := readyTx.ExecSubTx(id, 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.calls = nil
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"compensate-credit", "compensate-debit", "compensate-reserve"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestRollbackCompensatesByPriority(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("notify", rec.action("notify"), rec.action("compensate-notify"),
+		subtx.SetCompensationPriority(1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "priority-order")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"notify", "debit", "credit"} {
+		if err := readyTx.ExecSubTx(id, 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.calls = nil
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"compensate-notify", "compensate-credit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestRollbackSkipsAlreadyCompensatedSubTx(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.failingOnce("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.action("credit"), rec.action("compensate-credit")); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "resumable-rollback")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"debit", "credit"} {
+		if err := readyTx.ExecSubTx(id, 100, "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec.calls = nil
+
+	if err := readyTx.Rollback(1); err == nil {
+		t.Fatal("expected first rollback attempt to fail")
+	}
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"compensate-credit", "compensate-debit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestRollbackReadsBaselineCompensationLogs(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	for _, id := range []string{"debit", "credit"} {
+		if err := sagaForTx.AddSubTx(id, rec.action(id), rec.action("compensate-"+id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args, err := sagaForTx.MarshallArgs([]interface{}{100, "sam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the logs written before the Seq and EndCompensateSubTx were used, the rollback stopped after compensating debit
+	storage := memory.NewLogStorage()
+	for _, l := range []log.Log{
+		{Type: log.StartTx},
+		{Type: log.StartSubTx, SubTxID: "debit", Args: args},
+		{Type: log.EndSubTx, SubTxID: "debit"},
+		{Type: log.StartSubTx, SubTxID: "credit", Args: args},
+		{Type: log.EndSubTx, SubTxID: "credit"},
+		{Type: log.AbortTx},
+		{Type: log.StartCompensateSubTx, SubTxID: "debit"},
+		{Type: log.EndSubTx, SubTxID: "debit"},
+	} {
+		l.Time = time.Now()
+		data, err := marshal.Marshal(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.AppendLog("baseline", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "baseline")
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"compensate-credit"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected compensations: %v, got: %v", expected, rec.calls)
+	}
+	if readyTx.State() != tx.Aborted {
+		t.Fatalf("expected state: %s, got: %s", tx.Aborted, readyTx.State())
+	}
+}
+
+func TestCompensateReceivesActionResults(t *testing.T) {
+	var cancelled []string
+	reserve := func(c context.Context, item string, count int) (error, string) {
+		return nil, "reservation-of-" + item
+	}
+	cancel := func(c context.Context, item string, count int, reservationID string) error {
+		cancelled = append(cancelled, reservationID)
+		return nil
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("reserve", reserve, cancel, subtx.SetCompensateWithResults()); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "compensate-with-results")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := readyTx.ExecSubTxAndGetResult("reserve", "book", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[1].String() != "reservation-of-book" {
+		t.Fatalf("unexpected action result: %v", res[1])
+	}
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"reservation-of-book"}
+	if !reflect.DeepEqual(cancelled, expected) {
+		t.Fatalf("expected cancelled reservations: %v, got: %v", expected, cancelled)
+	}
+}
+
+func TestCompensateWithResultsRejectsMismatchedSignature(t *testing.T) {
+	reserve := func(c context.Context, item string) (error, string) {
+		return nil, ""
+	}
+	cancel := func(c context.Context, item string) error {
+		return nil
+	}
+
+	if err := New().AddSubTx("reserve", reserve, cancel, subtx.SetCompensateWithResults()); err == nil {
+		t.Fatal("expected error for compensate not accepting the action results")
+	}
+
+	mistyped := func(c context.Context, item string, reservationID int) error {
+		return nil
+	}
+	if err := New().AddSubTx("reserve", reserve, mistyped, subtx.SetCompensateWithResults()); err == nil {
+		t.Fatal("expected error for compensate not accepting the types of the action results")
+	}
+}
+
+func TestActionResultsThatCanNotBeLoggedAreLeftOut(t *testing.T) {
+	rec := &recorder{}
+	lookup := func(c context.Context, item string) (error, error) {
+		rec.record("lookup")
+		return nil, nil
+	}
+	subscribe := func(c context.Context, item string) (error, chan string) {
+		rec.record("subscribe")
+		return nil, make(chan string)
+	}
+	noop := func(c context.Context, item string) error {
+		return nil
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("lookup", lookup, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("subscribe", subscribe, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "results-left-out")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("lookup", "book"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := readyTx.ExecSubTxAndGetResult("subscribe", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[1].IsNil() {
+		t.Fatal("expected the channel returned by the action")
+	}
+
+	status, err := readyTx.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range status.Steps {
+		if step.State != tx.StepDone {
+			t.Fatalf("expected subTxID: %s to succeed, got: %s", step.SubTxID, step.State)
+		}
+	}
+}
+
+func TestRollbackAppliesUnfinishedPolicy(t *testing.T) {
+	rec := &recorder{}
+	probed := func(c context.Context, amount int, account string) (error, bool) {
+		rec.record("probe-" + account)
+		return nil, account == "pam"
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.failingAction("debit"), rec.action("compensate-debit"),
+		subtx.SetUnfinishedPolicy(subtx.SkipUnfinished)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit"),
+		subtx.SetStatusProbe(probed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("notify", rec.failingAction("notify"), rec.action("compensate-notify")); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "unfinished-policy")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = readyTx.ExecSubTx("debit", 100, "sam")
+	_ = readyTx.ExecSubTx("credit", 100, "sam")
+	_ = readyTx.ExecSubTx("credit", 100, "pam")
+	_ = readyTx.ExecSubTx("notify", 100, "pam")
+	rec.calls = nil
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"compensate-notify", "probe-pam", "compensate-credit", "probe-sam"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}
+
+func TestProbeUnfinishedPolicyNeedsStatusProbe(t *testing.T) {
+	rec := &recorder{}
+	err := New().AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit"),
+		subtx.SetUnfinishedPolicy(subtx.ProbeUnfinished))
+	if err == nil {
+		t.Fatal("expected error for ProbeUnfinished policy without status probe")
+	}
+}
+
+func TestRollbackStrategyGivesUpAndMarksCompensationFailed(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.failingAction("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "compensation-failed")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	strategy := tx.RollbackStrategy{
+		Backoff:     retry.Backoff{InitialInterval: time.Millisecond},
+		MaxAttempts: 3,
+		OnAttempt:   func(attempt int, err error) { attempts = attempt },
+	}
+	err := readyTx.RollbackWithStrategy(strategy)
+	if jujuerrors.Cause(err) != tx.ErrCompensationFailed {
+		t.Fatalf("expected ErrCompensationFailed, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 rollback attempts, got: %d", attempts)
+	}
+
+	counts := map[log.Type]int{}
+	for _, l := range getLogs(t, storage, "compensation-failed") {
+		counts[l.Type]++
+	}
+	if counts[log.AbortTx] != 1 || counts[log.CompensationFailedTx] != 1 {
+		t.Fatalf("expected single abort and compensation failed logs, got: %v", counts)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/vkaushik/saga/marshal"
 	"github.com/vkaushik/saga/subtx"
 	"github.com/vkaushik/saga/trace"
+	"github.com/vkaushik/saga/tx"
 	"reflect"
 )
 
@@ -17,22 +18,27 @@ func New() *Saga {
 // NewWithLogger creates and returns a new Saga instance with given Logger
 func NewWithLogger(l trace.Logger) *Saga {
 	return &Saga{
-		log:      l,
-		subTxDef: subtx.NewSubTxDefinitions(),
-		params:   subtx.NewParamTypeRegister(),
+		log:       l,
+		subTxDef:  subtx.NewSubTxDefinitions(),
+		params:    subtx.NewParamTypeRegister(),
+		pipelines: map[string]*Pipeline{},
 	}
 }
 
 // Saga helps SubTransaction execution and rollback
 type Saga struct {
-	log      trace.Logger
-	subTxDef SubTxDefinitions
-	params   ParamRegister
+	log       trace.Logger
+	subTxDef  SubTxDefinitions
+	params    ParamRegister
+	pipelines map[string]*Pipeline
+	listeners []tx.Listener
+
+	interceptors []subtx.Interceptor
 }
 
 // SubTxDefinitions contains methods to add sub-transaction definitions
 type SubTxDefinitions interface {
-	Add(subTxID string, action interface{}, compensate interface{}) error
+	Add(subTxID string, action interface{}, compensate interface{}, options ...func(*subtx.Definition) error) error
 	Get(subTxID string) (subtx.Definition, error)
 }
 
@@ -46,22 +52,49 @@ type ParamRegister interface {
 // AddSubTx registers the action and compensate methods for a SubTx that'll be identified with the SubTxID.
 // While Transaction execution, the SubTxID is used to identify the SubTx and execute it's action in success flow
 // or compensate if Tx is being rollback.
-func (s *Saga) AddSubTx(ID string, action interface{}, compensate interface{}) error {
+// It accepts functional options from subtx package to customize the SubTx definition e.g. subtx.SetCompensationPriority.
+// The compensate can be nil for the SubTx that's never compensated, i.e. of kind subtx.ReadOnly or subtx.Pivot.
+func (s *Saga) AddSubTx(ID string, action interface{}, compensate interface{}, options ...func(*subtx.Definition) error) error {
 	if err := s.params.Add(action); err != nil {
 		return errors.Annotatef(err, "could not parse action parameters for SubTxID: %s", ID)
 	}
 
-	if err := s.params.Add(compensate); err != nil {
-		return errors.Annotatef(err, "could not parse compensate parameters for SubTxID: %s", ID)
+	if compensate != nil {
+		if err := s.params.Add(compensate); err != nil {
+			return errors.Annotatef(err, "could not parse compensate parameters for SubTxID: %s", ID)
+		}
 	}
 
-	if err := s.subTxDef.Add(string(ID), action, compensate); err != nil {
+	if err := s.subTxDef.Add(string(ID), action, compensate, options...); err != nil {
 		return errors.Annotate(err, "could not add sub-transaction definitions")
 	}
 
 	return nil
 }
 
+// AddListener registers the Listener that's notified of the lifecycle events of all the Transactions of the saga.
+// Register the Listeners before executing the Transactions.
+func (s *Saga) AddListener(l tx.Listener) {
+	s.listeners = append(s.listeners, l)
+}
+
+// Listeners returns the Listeners registered with the saga, it implements tx.ListenerProvider.
+func (s *Saga) Listeners() []tx.Listener {
+	return s.listeners
+}
+
+// AddInterceptor registers the Interceptor that wraps the calls of the action, compensate and status probe of all the
+// SubTxs of the saga, e.g. to pass auth tokens or trace the calls. The Interceptors are called in the order they're
+// registered, before the ones of the SubTx set with subtx.SetInterceptors. Register them before executing the Transactions.
+func (s *Saga) AddInterceptor(i subtx.Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+// Interceptors returns the Interceptors registered with the saga, it implements tx.InterceptorProvider.
+func (s *Saga) Interceptors() []subtx.Interceptor {
+	return s.interceptors
+}
+
 func (s *Saga) GetSubTxDef(subTxID string) (subtx.Definition, error) {
 	return s.subTxDef.Get(subTxID)
 }
@@ -70,6 +103,9 @@ func (s *Saga) MarshallArgs(args []interface{}) ([]log.ArgData, error) {
 	res := make([]log.ArgData, 0, len(args))
 
 	for _, arg := range args {
+		if arg == nil {
+			return res, errors.New("could not marshal nil arg")
+		}
 		t, err := s.params.GetRegisteredTypeName(reflect.ValueOf(arg).Type())
 		if err != nil {
 			return res, errors.Annotate(err, "could not find argument type registered in saga")
@@ -0,0 +1,153 @@
+package saga
+
+import (
+	"context"
+	"testing"
+
+	jujuerrors "github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestStatusFollowsTransaction(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sagaForTx.AddSubTx("credit", rec.failingAction("credit"), rec.action("compensate-credit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "status")
+	assertState := func(expected tx.State) tx.Status {
+		status, err := readyTx.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != expected {
+			t.Fatalf("expected state: %s, got: %s", expected, status.State)
+		}
+		return status
+	}
+
+	assertState(tx.NotStarted)
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	_ = readyTx.ExecSubTx("credit", 100, "pam")
+
+	status := assertState(tx.Running)
+	if len(status.Steps) != 2 || status.Steps[0].State != tx.StepDone || status.Steps[1].State != tx.StepFailed {
+		t.Fatalf("unexpected steps: %+v", status.Steps)
+	}
+	if status.Steps[1].Error == "" {
+		t.Fatal("expected the error of the failed step")
+	}
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	status = assertState(tx.Aborted)
+	for _, s := range status.Steps {
+		if s.State != tx.StepCompensated {
+			t.Fatalf("expected compensated step, got: %+v", s)
+		}
+	}
+
+	if err := readyTx.End(); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on End after abort, got: %v", err)
+	}
+}
+
+func TestExecSubTxAfterEndIsIllegal(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "exec-after-end")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.End(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on ExecSubTx after End, got: %v", err)
+	}
+
+	// the state is restored from the logs
+	resumed := tx.New(context.Background(), sagaForTx, storage, "exec-after-end")
+	if err := resumed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on ExecSubTx after End, got: %v", err)
+	}
+
+	// the state is restored from the logs even if the Tx is neither started nor resumed
+	fresh := tx.New(context.Background(), sagaForTx, storage, "exec-after-end")
+	if err := fresh.ExecSubTx("debit", 100, "sam"); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on ExecSubTx after End, got: %v", err)
+	}
+	status, err := fresh.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Committed || len(status.Steps) != 0 || len(rec.calls) != 0 {
+		t.Fatalf("expected the committed transaction to be untouched, got: %+v, calls: %v", status, rec.calls)
+	}
+}
+
+func TestRollbackOfCommittedTxIsNotRetried(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.action("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "rollback-after-end")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	strategy := tx.RollbackStrategy{MaxAttempts: 2, OnAttempt: func(int, error) { attempts++ }}
+	if err := readyTx.RollbackWithStrategy(strategy); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on rollback after End, got: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected the rollback not to be retried, got %d attempts", attempts)
+	}
+
+	// the Tx that doesn't know the Transaction is committed doesn't roll it back either
+	fresh := tx.New(context.Background(), sagaForTx, storage, "rollback-after-end")
+	if err := fresh.RollbackWithStrategy(tx.DefaultRollbackStrategy()); jujuerrors.Cause(err) != tx.ErrIllegalTransition {
+		t.Fatalf("expected ErrIllegalTransition on rollback after End, got: %v", err)
+	}
+
+	status, err := fresh.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != tx.Committed {
+		t.Fatalf("expected the Transaction to stay committed, got: %s", status.State)
+	}
+	if len(rec.calls) != 1 {
+		t.Fatalf("unexpected calls: %v", rec.calls)
+	}
+}
@@ -2,10 +2,13 @@ package kafka
 
 import (
 	"github.com/vkaushik/saga/trace"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/vkaushik/saga/storage/kafka/topic"
+	"github.com/vkaushik/saga/tx"
 
 	"github.com/juju/errors"
 
@@ -38,6 +41,7 @@ type Kafka struct {
 	topic    Topic
 	producer sarama.SyncProducer
 	consumer sarama.Consumer
+	client   sarama.Client // client gets the partition offsets
 	logger   trace.Logger
 
 	pc      PartitionCount
@@ -76,6 +80,10 @@ func New(ver Version, brk BrokerAddresses, options ...func(*Kafka) error) (*Kafk
 		return nil, errors.Annotate(err, "could not create new consumer")
 	}
 
+	if k.client, err = sarama.NewClient(k.brokers, nil); err != nil {
+		return nil, errors.Annotate(err, "could not create new client")
+	}
+
 	// Warning: Please be careful with options
 	for _, setter := range options {
 		if err = setter(k); err != nil {
@@ -91,6 +99,18 @@ func (k *Kafka) SetDefaults() {
 	k.pc = 1
 	k.rc = 1
 	k.dur = ConsumerWaitDuration(5000)
+	k.logger = trace.NewDummyLogger()
+}
+
+// SetLogger is the functional option to set the Logger
+func SetLogger(l trace.Logger) func(*Kafka) error {
+	return func(k *Kafka) error {
+		if l == nil {
+			return errors.New("logger must not be nil")
+		}
+		k.logger = l
+		return nil
+	}
 }
 
 // SetNumberOfPartitions is the functional option to set PartitionCount
@@ -136,6 +156,120 @@ func SetNumberMaximumLogMessages(mc MaxLogMessages) func(*Kafka) error {
 
 // AppendLog
 func (k *Kafka) AppendLog(txID string, data string) error {
+	if err := k.createTopic(txID); err != nil {
+		return err
+	}
+
+	msg := &sarama.ProducerMessage{Topic: txID, Value: sarama.StringEncoder(data)}
+	partition, offset, err := k.producer.SendMessage(msg)
+	if err != nil {
+		return errors.Annotatef(err, "could not publish kafka message with data: %v, to topic: %v", data, txID)
+	}
+
+	k.logger.Info("message data: ,published to partition %d at offset %d\n", data, partition, offset)
+
+	return nil
+}
+
+// ListTxIDs returns the IDs of all the Transactions, i.e. the topics except the internal ones of Kafka, in sorted order.
+func (k *Kafka) ListTxIDs() ([]string, error) {
+	topics, err := k.topic.GetAllTopics()
+	if err != nil {
+		return nil, errors.Annotate(err, "could not get all topics")
+	}
+
+	ids := make([]string, 0, len(topics))
+	for _, t := range topics {
+		if strings.HasPrefix(t, "__") {
+			continue
+		}
+		ids = append(ids, t)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// QueryTxIDs returns a page of the IDs of the Transactions that match the query, see tx.Query.
+// The logs of every Transaction are read if the query filters by state or start time.
+func (k *Kafka) QueryTxIDs(q tx.Query) (tx.Page, error) {
+	ids, err := k.ListTxIDs()
+	if err != nil {
+		return tx.Page{}, err
+	}
+	return tx.FilterPage(ids, q, k.GetTxLogs)
+}
+
+// GetLastLog returns the latest log of the Transaction, it reads only the last message of each partition.
+func (k *Kafka) GetLastLog(txID string) (string, error) {
+	partitionList, err := k.consumer.Partitions(txID)
+	if err != nil {
+		return "", errors.Annotatef(err, "could not get partitions for topic: %v", txID)
+	}
+
+	var last *sarama.ConsumerMessage
+	for _, partition := range partitionList {
+		msg, err := k.lastMessage(txID, partition)
+		if err != nil {
+			return "", errors.Annotatef(err, "could not get last message of partition: %d", partition)
+		}
+		if msg != nil && (last == nil || msg.Timestamp.After(last.Timestamp)) {
+			last = msg
+		}
+	}
+	if last == nil {
+		return "", errors.NotFoundf("logs of TxID: %s", txID)
+	}
+
+	// the lease records and the fenced logs need all the messages to be told apart
+	if len(last.Headers) > 0 {
+		logs, err := k.GetTxLogs(txID)
+		if err != nil {
+			return "", err
+		}
+		if len(logs) == 0 {
+			return "", errors.NotFoundf("logs of TxID: %s", txID)
+		}
+		return logs[len(logs)-1], nil
+	}
+
+	return string(last.Value), nil
+}
+
+// lastMessage returns the last message of the partition, or nil if the partition is empty.
+func (k *Kafka) lastMessage(topic string, partition int32) (*sarama.ConsumerMessage, error) {
+	oldest, err := k.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not get oldest offset")
+	}
+	next, err := k.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not get newest offset")
+	}
+	if next <= oldest {
+		return nil, nil
+	}
+
+	pc, err := k.consumer.ConsumePartition(topic, partition, next-1)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not consume partition")
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+
+	timer := time.NewTimer(time.Duration(k.dur))
+	defer timer.Stop()
+	select {
+	case msg := <-pc.Messages():
+		return msg, nil
+	case <-timer.C:
+		return nil, errors.Timeoutf("last message of topic: %s", topic)
+	}
+}
+
+// createTopic creates the topic of the Transaction, unless it's already created.
+func (k *Kafka) createTopic(txID string) error {
 	topicExists, err := k.topic.IsTopicAlreadyCreated(txID)
 	if err != nil {
 		return errors.Annotatef(err, "could not check if topic: %v, is already created", txID)
@@ -147,19 +281,27 @@ func (k *Kafka) AppendLog(txID string, data string) error {
 		}
 	}
 
-	msg := &sarama.ProducerMessage{Topic: txID, Value: sarama.StringEncoder(data)}
-	partition, offset, err := k.producer.SendMessage(msg)
-	if err != nil {
-		return errors.Annotatef(err, "could not publish kafka message with data: %v, to topic: %v", data, txID)
-	}
-
-	k.logger.Info("message data: ,published to partition %d at offset %d\n", data, partition, offset)
-
 	return nil
 }
 
 // GetTxLogs to get Tx logs
+// The lease records are not logs, and the logs appended under a lease that was granted to anyone since are dropped.
 func (k *Kafka) GetTxLogs(txID string) ([]string, error) {
+	msgs, err := k.consume(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, logs := replayLeases(msgs)
+	data := make([]string, 0, len(logs))
+	for _, msg := range logs {
+		data = append(data, string(msg.Value))
+	}
+	return data, nil
+}
+
+// consume reads all the messages of the topic, the messages of each partition are in order.
+func (k *Kafka) consume(txID string) ([]*sarama.ConsumerMessage, error) {
 	partitionList, err := k.consumer.Partitions(txID)
 	if err != nil {
 		return nil, errors.Annotatef(err, "could not get partitions for topic: %v", txID)
@@ -168,27 +310,25 @@ func (k *Kafka) GetTxLogs(txID string) ([]string, error) {
 	var wg sync.WaitGroup
 	// TODO: refactor channel sizes, wg usage
 	msgs := make(chan *sarama.ConsumerMessage, int(k.maxMsgs))
-	errs := make(chan error, int(k.maxMsgs))
+	errs := make(chan error, len(partitionList))
 	for _, partition := range partitionList {
 		wg.Add(1)
 		go consumePartition(k.consumer, txID, partition, msgs, errs, time.Duration(k.dur), &wg)
 	}
+	go func() {
+		wg.Wait()
+		close(msgs)
+	}()
 
-	wg.Wait()
-
-	data := make([]string, 0, int(k.maxMsgs))
-	timer := time.NewTimer(time.Duration(k.dur))
-	defer timer.Stop()
-	for {
-		select {
-		case <-timer.C:
-			return data, nil
-		case msg := <-msgs:
-			data = append(data, string(msg.Value))
-			timer.Reset(time.Duration(k.dur))
-		case err := <-errs:
-			return data, errors.Annotate(err, "one of the partition-consumers failed")
-		}
+	data := make([]*sarama.ConsumerMessage, 0, int(k.maxMsgs))
+	for msg := range msgs {
+		data = append(data, msg)
+	}
+	select {
+	case err := <-errs:
+		return data, errors.Annotate(err, "one of the partition-consumers failed")
+	default:
+		return data, nil
 	}
 }
 
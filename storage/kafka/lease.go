@@ -0,0 +1,232 @@
+package kafka
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/tx"
+)
+
+// Kafka has no compare-and-set, so the leases are records in the topic of the Transaction along with its logs.
+// The records are keyed by TxID, so that they're kept in order in a single partition. Replaying the records in order
+// tells which lease is held, and the logs appended with the epoch of a lease that's not held are dropped on read.
+const (
+	leaseHeader = "saga-lease" // leaseHeader marks the lease records
+	epochHeader = "saga-epoch" // epochHeader is the epoch of the lease under which a log is appended
+)
+
+type leaseOp string
+
+const (
+	acquireOp leaseOp = "acquire"
+	renewOp   leaseOp = "renew"
+	releaseOp leaseOp = "release"
+)
+
+// leaseRecord is the value of a lease record.
+type leaseRecord struct {
+	Op    leaseOp   `json:"op"`
+	Lease tx.Lease  `json:"lease"`
+	At    time.Time `json:"at"` // At is the time the record is written, the expiry of the held lease is checked at it.
+}
+
+// AcquireLease grants the lease of the Transaction to the owner with a new epoch, see tx.Leaser.
+// The lease is granted if the acquire record is the first one with the new epoch in the topic.
+func (k *Kafka) AcquireLease(txID, owner string, ttl time.Duration) (tx.Lease, error) {
+	held, epoch, err := k.currentLease(txID)
+	if err != nil {
+		return tx.Lease{}, err
+	}
+	now := time.Now()
+	if held != nil && held.Owner != owner && now.Before(held.Expires) {
+		return tx.Lease{}, errors.Annotatef(tx.ErrLeaseHeld, "lease of TxID: %s is held by: %s until: %s", txID, held.Owner, held.Expires)
+	}
+
+	lease := tx.Lease{TxID: txID, Owner: owner, Epoch: epoch + 1, Expires: now.Add(ttl)}
+	if err := k.writeLease(leaseRecord{Op: acquireOp, Lease: lease, At: now}); err != nil {
+		return tx.Lease{}, err
+	}
+
+	// another owner may have acquired the lease in the meanwhile
+	if held, _, err = k.currentLease(txID); err != nil {
+		return tx.Lease{}, err
+	}
+	if held == nil || held.Epoch != lease.Epoch || held.Owner != owner {
+		return tx.Lease{}, errors.Annotatef(tx.ErrLeaseHeld, "lease of TxID: %s is acquired by another owner", txID)
+	}
+
+	return lease, nil
+}
+
+// RenewLease extends the lease if it's still held, see tx.Leaser.
+func (k *Kafka) RenewLease(lease tx.Lease, ttl time.Duration) (tx.Lease, error) {
+	now := time.Now()
+	renewed := lease
+	renewed.Expires = now.Add(ttl)
+	if err := k.writeLease(leaseRecord{Op: renewOp, Lease: renewed, At: now}); err != nil {
+		return lease, err
+	}
+
+	held, _, err := k.currentLease(lease.TxID)
+	if err != nil {
+		return lease, err
+	}
+	if held == nil || held.Epoch != lease.Epoch {
+		return lease, errors.Annotatef(tx.ErrFenced, "lease of TxID: %s with epoch: %d is not held", lease.TxID, lease.Epoch)
+	}
+
+	return renewed, nil
+}
+
+// ReleaseLease gives up the lease, see tx.Leaser. The release record of a lease that's not held is ignored.
+func (k *Kafka) ReleaseLease(lease tx.Lease) error {
+	return k.writeLease(leaseRecord{Op: releaseOp, Lease: lease, At: time.Now()})
+}
+
+// AppendLogFenced appends the log with the epoch of the lease, see tx.Leaser. The log is dropped on read
+// if the lease is not held when it's appended.
+func (k *Kafka) AppendLogFenced(txID string, epoch int64, data string) error {
+	held, _, err := k.currentLease(txID)
+	if err != nil {
+		return err
+	}
+	if held == nil || held.Epoch != epoch {
+		return errors.Annotatef(tx.ErrFenced, "lease of TxID: %s with epoch: %d is not held", txID, epoch)
+	}
+
+	header := sarama.RecordHeader{Key: []byte(epochHeader), Value: []byte(strconv.FormatInt(epoch, 10))}
+	partition, offset, err := k.send(txID, data, header)
+	if err != nil {
+		return err
+	}
+
+	// the lease may have been acquired by another owner before the log was appended
+	msgs, err := k.consume(txID)
+	if err != nil {
+		return err
+	}
+	_, logs := replayLeases(msgs)
+	for _, msg := range logs {
+		if msg.Partition == partition && msg.Offset == offset {
+			return nil
+		}
+	}
+	return errors.Annotatef(tx.ErrFenced, "log of TxID: %s with epoch: %d is appended after the lease is lost", txID, epoch)
+}
+
+// currentLease returns the lease held, if any, and the epoch of the latest lease granted.
+func (k *Kafka) currentLease(txID string) (*tx.Lease, int64, error) {
+	exists, err := k.topic.IsTopicAlreadyCreated(txID)
+	if err != nil {
+		return nil, 0, errors.Annotatef(err, "could not check if topic: %v, is already created", txID)
+	}
+	if !exists {
+		return nil, 0, nil
+	}
+
+	msgs, err := k.consume(txID)
+	if err != nil {
+		return nil, 0, err
+	}
+	state, _ := replayLeases(msgs)
+	return state.held, state.epoch, nil
+}
+
+// writeLease appends the lease record to the topic of the Transaction.
+func (k *Kafka) writeLease(record leaseRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Annotate(err, "could not marshal lease record")
+	}
+
+	_, _, err = k.send(record.Lease.TxID, string(value), sarama.RecordHeader{Key: []byte(leaseHeader), Value: []byte(record.Op)})
+	return err
+}
+
+// send publishes the message keyed by TxID with given header to the topic of the Transaction, creating the topic if needed.
+func (k *Kafka) send(txID string, data string, header sarama.RecordHeader) (int32, int64, error) {
+	if err := k.createTopic(txID); err != nil {
+		return 0, 0, err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:   txID,
+		Key:     sarama.StringEncoder(txID),
+		Value:   sarama.StringEncoder(data),
+		Headers: []sarama.RecordHeader{header},
+	}
+	partition, offset, err := k.producer.SendMessage(msg)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "could not publish kafka message with data: %v, to topic: %v", data, txID)
+	}
+
+	return partition, offset, nil
+}
+
+// leaseState is the state of the lease of a Transaction, replayed from its lease records.
+type leaseState struct {
+	held  *tx.Lease
+	epoch int64
+}
+
+// replayLeases replays the lease records of the messages in order, and returns the state of the lease along with
+// the log messages, i.e. the messages that are not lease records and are not appended under a lease that's not held.
+func replayLeases(msgs []*sarama.ConsumerMessage) (leaseState, []*sarama.ConsumerMessage) {
+	var state leaseState
+	logs := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if header(msg, leaseHeader) != nil {
+			var record leaseRecord
+			if err := json.Unmarshal(msg.Value, &record); err == nil {
+				state.apply(record)
+			}
+			continue
+		}
+
+		if epoch := header(msg, epochHeader); epoch != nil {
+			e, err := strconv.ParseInt(string(epoch), 10, 64)
+			if err != nil || state.held == nil || state.held.Epoch != e {
+				continue
+			}
+		}
+		logs = append(logs, msg)
+	}
+
+	return state, logs
+}
+
+// apply applies the lease record to the state, the records that don't follow the held lease are ignored.
+func (s *leaseState) apply(record leaseRecord) {
+	lease := record.Lease
+	switch record.Op {
+	case acquireOp:
+		if lease.Epoch != s.epoch+1 {
+			return
+		}
+		if s.held != nil && s.held.Owner != lease.Owner && record.At.Before(s.held.Expires) {
+			return
+		}
+		s.epoch, s.held = lease.Epoch, &lease
+	case renewOp:
+		if s.held != nil && s.held.Epoch == lease.Epoch {
+			s.held = &lease
+		}
+	case releaseOp:
+		if s.held != nil && s.held.Epoch == lease.Epoch {
+			s.held = nil
+		}
+	}
+}
+
+// header returns the value of the header of the message, or nil if it has no such header.
+func header(msg *sarama.ConsumerMessage, key string) []byte {
+	for _, h := range msg.Headers {
+		if h != nil && string(h.Key) == key {
+			return h.Value
+		}
+	}
+	return nil
+}
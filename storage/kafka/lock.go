@@ -0,0 +1,153 @@
+package kafka
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/tx"
+)
+
+// The locks of resources are records in a topic shared by all the Transactions. The records are keyed by the key of
+// the resource, so that the records of a resource are kept in order in a single partition. Replaying the records
+// in order tells which Transaction holds the lock of each resource, the first lock record of a free resource wins.
+const locksTopic = "__saga_locks"
+
+type lockOp string
+
+const (
+	lockOpLock   lockOp = "lock"
+	lockOpUnlock lockOp = "unlock"
+)
+
+// lockRecord is the value of a lock record.
+type lockRecord struct {
+	Op   lockOp    `json:"op"`
+	Key  string    `json:"key"`
+	TxID string    `json:"txID"`
+	At   time.Time `json:"at"`
+}
+
+// AcquireLocks locks the resources for the Transaction, all or none, see tx.Locker. The lock records are written
+// for the free resources, and if another Transaction locked any of them in the meanwhile, the locks are released.
+func (k *Kafka) AcquireLocks(txID string, keys []string) error {
+	holders, err := k.lockHolders()
+	if err != nil {
+		return err
+	}
+	var free []string
+	for _, key := range keys {
+		holder, ok := holders[key]
+		if ok && holder != txID {
+			return errors.Annotatef(tx.ErrLocked, "resource: %s is locked by TxID: %s", key, holder)
+		}
+		if !ok {
+			free = append(free, key)
+		}
+	}
+	if len(free) == 0 {
+		return nil
+	}
+
+	for _, key := range free {
+		if err := k.writeLock(lockRecord{Op: lockOpLock, Key: key, TxID: txID, At: time.Now()}); err != nil {
+			return err
+		}
+	}
+
+	if holders, err = k.lockHolders(); err != nil {
+		return err
+	}
+	for _, key := range free {
+		if holder := holders[key]; holder != txID {
+			if err := k.unlock(txID, free, holders); err != nil {
+				return err
+			}
+			return errors.Annotatef(tx.ErrLocked, "resource: %s is locked by TxID: %s", key, holder)
+		}
+	}
+
+	return nil
+}
+
+// ReleaseLocks releases the locks held by the Transaction, see tx.Locker.
+func (k *Kafka) ReleaseLocks(txID string) error {
+	holders, err := k.lockHolders()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(holders))
+	for key := range holders {
+		keys = append(keys, key)
+	}
+	return k.unlock(txID, keys, holders)
+}
+
+// unlock writes the unlock records of given keys whose locks are held by the Transaction.
+func (k *Kafka) unlock(txID string, keys []string, holders map[string]string) error {
+	for _, key := range keys {
+		if holders[key] != txID {
+			continue
+		}
+		if err := k.writeLock(lockRecord{Op: lockOpUnlock, Key: key, TxID: txID, At: time.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockHolders replays the lock records and returns the TxIDs holding the locks, by key of the resource.
+func (k *Kafka) lockHolders() (map[string]string, error) {
+	holders := map[string]string{}
+	exists, err := k.topic.IsTopicAlreadyCreated(locksTopic)
+	if err != nil {
+		return nil, errors.Annotatef(err, "could not check if topic: %v, is already created", locksTopic)
+	}
+	if !exists {
+		return holders, nil
+	}
+
+	msgs, err := k.consume(locksTopic)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		var record lockRecord
+		if err := json.Unmarshal(msg.Value, &record); err != nil {
+			continue
+		}
+		holder, held := holders[record.Key]
+		switch {
+		case record.Op == lockOpLock && !held:
+			holders[record.Key] = record.TxID
+		case record.Op == lockOpUnlock && held && holder == record.TxID:
+			delete(holders, record.Key)
+		}
+	}
+
+	return holders, nil
+}
+
+// writeLock appends the lock record to the locks topic, keyed by the key of the resource.
+func (k *Kafka) writeLock(record lockRecord) error {
+	if err := k.createTopic(locksTopic); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Annotate(err, "could not marshal lock record")
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: locksTopic,
+		Key:   sarama.StringEncoder(record.Key),
+		Value: sarama.ByteEncoder(value),
+	}
+	if _, _, err := k.producer.SendMessage(msg); err != nil {
+		return errors.Annotatef(err, "could not publish lock record for resource: %v", record.Key)
+	}
+
+	return nil
+}
@@ -1,19 +1,48 @@
 package memory
 
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/tx"
+)
+
 func NewLogStorage() *LogCache {
-	return &LogCache{map[string][]string{}}
+	return &LogCache{
+		logs:   map[string][]string{},
+		leases: map[string]tx.Lease{},
+		epochs: map[string]int64{},
+		locks:  map[string]string{},
+	}
 }
 
+// LogCache keeps the Tx logs in memory. It's safe for concurrent use.
 type LogCache struct {
-	logs map[string][]string
+	mu     sync.RWMutex
+	logs   map[string][]string
+	leases map[string]tx.Lease // leases are the leases held, by TxID
+	epochs map[string]int64    // epochs are the epochs of the latest lease granted, by TxID
+	locks  map[string]string   // locks are the TxIDs holding the locks of resources, by key
 }
 
 func (c *LogCache) TxIDAlreadyExists(id string) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	_, ok := c.logs[id]
 	return ok, nil
 }
 
+// AppendLog appends the log of the Transaction. It's refused with tx.ErrLeaseHeld while the lease of the Transaction
+// is held and not expired, as the logs of the owner are appended with AppendLogFenced.
 func (c *LogCache) AppendLog(id string, logData string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held, ok := c.leases[id]; ok && time.Now().Before(held.Expires) {
+		return errors.Annotatef(tx.ErrLeaseHeld, "lease of TxID: %s is held by: %s until: %s", id, held.Owner, held.Expires)
+	}
+
 	if logs, ok := c.logs[id]; ok {
 		c.logs[id] = append(logs, logData)
 	} else {
@@ -24,5 +53,126 @@ func (c *LogCache) AppendLog(id string, logData string) error {
 }
 
 func (c *LogCache) GetTxLogs(id string) ([]string, error) {
-	return c.logs[id], nil
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.logs[id]...), nil
+}
+
+// ListTxIDs returns the IDs of all the Transactions in the cache, in sorted order.
+func (c *LogCache) ListTxIDs() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0, len(c.logs))
+	for id := range c.logs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// QueryTxIDs returns a page of the IDs of the Transactions in the cache that match the query, see tx.Query.
+func (c *LogCache) QueryTxIDs(q tx.Query) (tx.Page, error) {
+	ids, err := c.ListTxIDs()
+	if err != nil {
+		return tx.Page{}, err
+	}
+	return tx.FilterPage(ids, q, c.GetTxLogs)
+}
+
+// GetLastLog returns the latest log of the Transaction.
+func (c *LogCache) GetLastLog(id string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	logs := c.logs[id]
+	if len(logs) == 0 {
+		return "", errors.NotFoundf("logs of TxID: %s", id)
+	}
+	return logs[len(logs)-1], nil
+}
+
+// AcquireLease grants the lease of the Transaction to the owner with a new epoch, see tx.Leaser.
+func (c *LogCache) AcquireLease(id, owner string, ttl time.Duration) (tx.Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held, ok := c.leases[id]; ok && held.Owner != owner && time.Now().Before(held.Expires) {
+		return tx.Lease{}, errors.Annotatef(tx.ErrLeaseHeld, "lease of TxID: %s is held by: %s until: %s", id, held.Owner, held.Expires)
+	}
+
+	c.epochs[id]++
+	lease := tx.Lease{TxID: id, Owner: owner, Epoch: c.epochs[id], Expires: time.Now().Add(ttl)}
+	c.leases[id] = lease
+	return lease, nil
+}
+
+// RenewLease extends the lease if it's still held, see tx.Leaser.
+func (c *LogCache) RenewLease(lease tx.Lease, ttl time.Duration) (tx.Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkEpoch(lease.TxID, lease.Epoch); err != nil {
+		return lease, err
+	}
+
+	lease.Expires = time.Now().Add(ttl)
+	c.leases[lease.TxID] = lease
+	return lease, nil
+}
+
+// ReleaseLease gives up the lease if it's still held, see tx.Leaser.
+func (c *LogCache) ReleaseLease(lease tx.Lease) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkEpoch(lease.TxID, lease.Epoch); err != nil {
+		return err
+	}
+
+	delete(c.leases, lease.TxID)
+	return nil
+}
+
+// AppendLogFenced appends the log if the lease of given epoch is still held, see tx.Leaser.
+func (c *LogCache) AppendLogFenced(id string, epoch int64, logData string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkEpoch(id, epoch); err != nil {
+		return err
+	}
+
+	c.logs[id] = append(c.logs[id], logData)
+	return nil
+}
+
+// checkEpoch returns tx.ErrFenced unless the lease of given epoch is held, the caller must hold the lock.
+func (c *LogCache) checkEpoch(id string, epoch int64) error {
+	if held, ok := c.leases[id]; !ok || held.Epoch != epoch {
+		return errors.Annotatef(tx.ErrFenced, "lease of TxID: %s with epoch: %d is not held", id, epoch)
+	}
+	return nil
+}
+
+// AcquireLocks locks the resources for the Transaction, all or none, see tx.Locker.
+func (c *LogCache) AcquireLocks(id string, keys []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if holder, ok := c.locks[key]; ok && holder != id {
+			return errors.Annotatef(tx.ErrLocked, "resource: %s is locked by TxID: %s", key, holder)
+		}
+	}
+
+	for _, key := range keys {
+		c.locks[key] = id
+	}
+	return nil
+}
+
+// ReleaseLocks releases the locks held by the Transaction, see tx.Locker.
+func (c *LogCache) ReleaseLocks(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, holder := range c.locks {
+		if holder == id {
+			delete(c.locks, key)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,70 @@
+package subtx
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// Phase is the phase of the SubTx execution a function is called for.
+type Phase int
+
+const (
+	// ActionPhase denotes that the action of the SubTx is called.
+	ActionPhase Phase = iota + 1
+
+	// CompensatePhase denotes that the compensate of the SubTx is called.
+	CompensatePhase
+
+	// ProbePhase denotes that the status probe of the SubTx is called, see SetStatusProbe.
+	ProbePhase
+)
+
+var phaseNames = map[Phase]string{
+	ActionPhase:     "action",
+	CompensatePhase: "compensate",
+	ProbePhase:      "probe",
+}
+
+func (p Phase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Invocation is a call of the action, compensate or status probe of a SubTx, as seen by the Interceptors.
+type Invocation struct {
+	Definition Definition
+	Phase      Phase
+	Args       []reflect.Value // Args are the arguments of the function, without the context.
+}
+
+// Handler calls the function of the Invocation with the context as first argument, and returns the results of the
+// function along with the error returned by it. The results are the ones of the function, i.e. the error is first.
+type Handler func(ctx context.Context, inv Invocation) ([]reflect.Value, error)
+
+// Interceptor wraps the call of the function of a SubTx, e.g. to pass auth tokens in the context, trace or rate limit
+// the calls. It calls next to continue the call, it may change the context, the Invocation or the results, or return
+// its own results without calling next. The results must match the results of the function, with the error first.
+type Interceptor func(ctx context.Context, inv Invocation, next Handler) ([]reflect.Value, error)
+
+// SetInterceptors is the functional option to wrap the calls of the functions of the SubTx with the Interceptors,
+// the first one is the outermost. They're called within the Interceptors of the saga.
+func SetInterceptors(interceptors ...Interceptor) func(*Definition) error {
+	return func(d *Definition) error {
+		for _, i := range interceptors {
+			if i == nil {
+				return errors.New("interceptor must not be nil")
+			}
+		}
+		d.interceptors = append(d.interceptors, interceptors...)
+		return nil
+	}
+}
+
+// GetInterceptors returns the Interceptors of the SubTx.
+func (d *Definition) GetInterceptors() []Interceptor {
+	return d.interceptors
+}
@@ -0,0 +1,75 @@
+package subtx
+
+import (
+	"reflect"
+
+	"github.com/juju/errors"
+)
+
+// LockConflictPolicy decides what the Transaction does when the resources of the SubTx are locked by another
+// Transaction, see SetLockKeys.
+type LockConflictPolicy int
+
+const (
+	// FailOnConflict fails the SubTx execution with tx.ErrLocked without calling the action. It's the default.
+	FailOnConflict LockConflictPolicy = iota
+
+	// WaitOnConflict waits until the resources are unlocked, the Transaction context is done or its deadline passes.
+	WaitOnConflict
+
+	// FlagOnConflict executes the SubTx without locking the resources, the conflict is traced and notified to the
+	// Listeners of the Transaction with tx.EventLockConflict.
+	FlagOnConflict
+)
+
+// SetLockKeys is the functional option to lock the business resources touched by the SubTx, so that the concurrent
+// Transactions don't interleave on them. The keys function is called with the arguments of the action without the
+// context, and returns the keys of the resources e.g. for action func(ctx, amount int, account string) error
+// the keys function is func(amount int, account string) []string returning []string{"account:" + account}.
+// The resources are locked before the action is called, and unlocked once the Transaction is ended or rolled back.
+// The storage of the Transaction must implement tx.Locker.
+func SetLockKeys(keys interface{}) func(*Definition) error {
+	return func(d *Definition) error {
+		keysFunc := reflect.ValueOf(keys)
+		if keysFunc.Kind() != reflect.Func {
+			return errors.New("lock keys must be a function")
+		}
+
+		keysType, actionType := keysFunc.Type(), d.action.Type()
+		if keysType.NumOut() != 1 || keysType.Out(0) != reflect.TypeOf([]string(nil)) {
+			return errors.New("lock keys function must return []string")
+		}
+		if keysType.NumIn() != actionType.NumIn()-1 {
+			return errors.New("lock keys function must accept the action arguments without the context")
+		}
+		for i := 0; i < keysType.NumIn(); i++ {
+			if keysType.In(i) != actionType.In(i+1) {
+				return errors.New("lock keys function must accept the action arguments without the context")
+			}
+		}
+
+		d.lockKeys = keysFunc
+		return nil
+	}
+}
+
+// SetLockConflictPolicy is the functional option to set what the Transaction does when the resources of the SubTx
+// are locked by another Transaction. It needs the lock keys, see SetLockKeys.
+func SetLockConflictPolicy(policy LockConflictPolicy) func(*Definition) error {
+	return func(d *Definition) error {
+		if policy < FailOnConflict || policy > FlagOnConflict {
+			return errors.Errorf("unknown lock conflict policy: %d", policy)
+		}
+		d.lockConflictPolicy = policy
+		return nil
+	}
+}
+
+// GetLockKeys returns the function that derives the keys of the resources locked by the SubTx from its arguments.
+func (d *Definition) GetLockKeys() reflect.Value {
+	return d.lockKeys
+}
+
+func (d *Definition) GetLockConflictPolicy() LockConflictPolicy {
+	return d.lockConflictPolicy
+}
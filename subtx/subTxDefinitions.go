@@ -3,8 +3,10 @@ package subtx
 import (
 	"context"
 	"reflect"
+	"time"
 
 	"github.com/juju/errors"
+	"github.com/vkaushik/saga/retry"
 )
 
 func NewSubTxDefinitions() *Definitions {
@@ -18,6 +20,69 @@ type Definition struct {
 	subTxID    string
 	action     reflect.Value
 	compensate reflect.Value
+
+	compensationPriority  int
+	compensateWithResults bool
+	unfinishedPolicy      UnfinishedPolicy
+	unfinishedPolicySet   bool
+	statusProbe           reflect.Value
+	actionTimeout         time.Duration
+	compensateTimeout     time.Duration
+	retryPolicy           retry.Policy
+	kind                  Kind
+	interceptors          []Interceptor
+	lockKeys              reflect.Value
+	lockConflictPolicy    LockConflictPolicy
+}
+
+// Kind classifies a SubTx by how a Transaction recovers from its failure.
+type Kind int
+
+const (
+	// Compensatable SubTx is compensated when the Transaction is rolled back. It's the default.
+	Compensatable Kind = iota
+
+	// Pivot SubTx is the go/no-go point of the Transaction. If it fails, the Transaction is rolled back, and it's never
+	// compensated. Once it has ended, the Transaction can't be rolled back, and must go forward.
+	Pivot
+
+	// Retriable SubTx is retried until it's successful after the Pivot SubTx has ended, it's meant for the SubTxs
+	// executed after the Pivot SubTx.
+	Retriable
+
+	// ReadOnly SubTx has no effect to compensate, e.g. a lookup or a notification. It's logged like the other SubTxs,
+	// and skipped when the Transaction is rolled back, so it needs no compensate.
+	ReadOnly
+)
+
+// UnfinishedPolicy decides what rollback does with a SubTx whose action was started but never ended,
+// i.e. the action returned an error or the process crashed while executing it.
+type UnfinishedPolicy int
+
+const (
+	// CompensateUnfinished compensates the unfinished SubTx, as the action might have been applied. It's the default,
+	// unless the Transaction sets another default, e.g. the Pipelines skip the unfinished SubTxs.
+	CompensateUnfinished UnfinishedPolicy = iota
+
+	// SkipUnfinished doesn't compensate the unfinished SubTx.
+	SkipUnfinished
+
+	// ProbeUnfinished calls the status probe of the SubTx to decide whether to compensate the unfinished SubTx.
+	ProbeUnfinished
+)
+
+// SetCompensationPriority is the functional option to set the compensation priority of a SubTx.
+// During rollback the SubTxs with higher priority are compensated first, the SubTxs with same priority
+// are compensated in the reverse order of their execution. Default priority is 0.
+func SetCompensationPriority(priority int) func(*Definition) error {
+	return func(d *Definition) error {
+		d.compensationPriority = priority
+		return nil
+	}
+}
+
+func (d *Definition) GetSubTxID() string {
+	return d.subTxID
 }
 
 func (d *Definition) GetAction() reflect.Value {
@@ -28,6 +93,167 @@ func (d *Definition) GetCompensate() reflect.Value {
 	return d.compensate
 }
 
+// HasCompensate tells if the SubTx is compensated when the Transaction is rolled back, i.e. it has a compensate
+// and it's not ReadOnly.
+func (d *Definition) HasCompensate() bool {
+	return d.compensate.IsValid() && d.kind != ReadOnly
+}
+
+func (d *Definition) GetCompensationPriority() int {
+	return d.compensationPriority
+}
+
+func (d *Definition) IsCompensateWithResults() bool {
+	return d.compensateWithResults
+}
+
+func (d *Definition) GetActionTimeout() time.Duration {
+	return d.actionTimeout
+}
+
+func (d *Definition) GetCompensateTimeout() time.Duration {
+	return d.compensateTimeout
+}
+
+// SetActionTimeout is the functional option to set the timeout for the SubTx action.
+// The action gets a context derived from the Transaction context with the timeout as deadline.
+func SetActionTimeout(timeout time.Duration) func(*Definition) error {
+	return func(d *Definition) error {
+		if timeout <= 0 {
+			return errors.New("action timeout must be greater than 0")
+		}
+		d.actionTimeout = timeout
+		return nil
+	}
+}
+
+// SetCompensateTimeout is the functional option to set the timeout for the SubTx compensate and status probe.
+// The compensate gets a context derived from the Transaction context with the timeout as deadline.
+func SetCompensateTimeout(timeout time.Duration) func(*Definition) error {
+	return func(d *Definition) error {
+		if timeout <= 0 {
+			return errors.New("compensate timeout must be greater than 0")
+		}
+		d.compensateTimeout = timeout
+		return nil
+	}
+}
+
+func (d *Definition) GetRetryPolicy() retry.Policy {
+	return d.retryPolicy
+}
+
+// SetRetryPolicy is the functional option to retry the failed SubTx action as per the policy.
+// By default the action is attempted once.
+func SetRetryPolicy(policy retry.Policy) func(*Definition) error {
+	return func(d *Definition) error {
+		if policy.MaxAttempts < 1 {
+			return errors.New("max attempts of retry policy must be greater than 0")
+		}
+		d.retryPolicy = policy
+		return nil
+	}
+}
+
+func (d *Definition) GetKind() Kind {
+	return d.kind
+}
+
+// SetKind is the functional option to classify the SubTx as Compensatable, Pivot, Retriable or ReadOnly.
+// A Retriable SubTx is retried until it's successful with the backoff of its retry policy once a Pivot SubTx has
+// ended, unless the error is not retryable, see SetRetryPolicy. Before that, it's retried as per its retry policy.
+func SetKind(kind Kind) func(*Definition) error {
+	return func(d *Definition) error {
+		if kind < Compensatable || kind > ReadOnly {
+			return errors.Errorf("unknown kind: %d", kind)
+		}
+		d.kind = kind
+		return nil
+	}
+}
+
+func (d *Definition) GetUnfinishedPolicy() UnfinishedPolicy {
+	return d.unfinishedPolicy
+}
+
+// HasUnfinishedPolicy tells if the unfinished policy is set for the SubTx, see SetUnfinishedPolicy.
+func (d *Definition) HasUnfinishedPolicy() bool {
+	return d.unfinishedPolicySet
+}
+
+func (d *Definition) GetStatusProbe() reflect.Value {
+	return d.statusProbe
+}
+
+// SetUnfinishedPolicy is the functional option to set what rollback does with the SubTx if its action never ended.
+// ProbeUnfinished policy needs a status probe, see SetStatusProbe.
+func SetUnfinishedPolicy(policy UnfinishedPolicy) func(*Definition) error {
+	return func(d *Definition) error {
+		if policy < CompensateUnfinished || policy > ProbeUnfinished {
+			return errors.Errorf("unknown unfinished policy: %d", policy)
+		}
+		d.unfinishedPolicy, d.unfinishedPolicySet = policy, true
+		return nil
+	}
+}
+
+// SetStatusProbe is the functional option to set the status probe and ProbeUnfinished policy for the SubTx.
+// The probe is called during rollback if the action never ended, with the arguments of the action. It must return
+// an error as first return value and true as second return value if the action was applied and needs compensation,
+// e.g. for action func(ctx, amount int, from string) error the probe is func(ctx, amount int, from string) (error, bool)
+func SetStatusProbe(probe interface{}) func(*Definition) error {
+	return func(d *Definition) error {
+		probeFunc, err := validateAndGetFuncValue(probe)
+		if err != nil {
+			return errors.Annotate(err, "invalid status probe")
+		}
+
+		probeType, actionType := probeFunc.Type(), d.action.Type()
+		if probeType.NumOut() != 2 || probeType.Out(1).Kind() != reflect.Bool {
+			return errors.Errorf("status probe must return a bool after the error")
+		}
+		if probeType.NumIn() != actionType.NumIn() {
+			return errors.Errorf("status probe must accept the action arguments")
+		}
+		for i := 1; i < probeType.NumIn(); i++ {
+			if probeType.In(i) != actionType.In(i) {
+				return errors.Errorf("status probe must accept the action arguments")
+			}
+		}
+
+		d.statusProbe = probeFunc
+		d.unfinishedPolicy, d.unfinishedPolicySet = ProbeUnfinished, true
+		return nil
+	}
+}
+
+// SetCompensateWithResults is the functional option to pass the results of the SubTx action to its compensate.
+// The compensate must accept the non-error results of the action after the action arguments e.g.
+// for action func(ctx, item string) (error, ReservationID) the compensate is func(ctx, item string, id ReservationID) error
+func SetCompensateWithResults() func(*Definition) error {
+	return func(d *Definition) error {
+		if !d.compensate.IsValid() {
+			return errors.New("compensate must be set to pass the action results to it")
+		}
+		actionType, compensateType := d.action.Type(), d.compensate.Type()
+		if compensateType.NumIn() != actionType.NumIn()+actionType.NumOut()-1 {
+			return errors.Errorf("compensate must accept the action arguments followed by the action results")
+		}
+		for i := 1; i < actionType.NumIn(); i++ {
+			if compensateType.In(i) != actionType.In(i) {
+				return errors.Errorf("compensate must accept the action arguments followed by the action results")
+			}
+		}
+		for i := 1; i < actionType.NumOut(); i++ {
+			if compensateType.In(actionType.NumIn()+i-1) != actionType.Out(i) {
+				return errors.Errorf("compensate must accept the action arguments followed by the action results")
+			}
+		}
+		d.compensateWithResults = true
+		return nil
+	}
+}
+
 func (d *Definitions) Get(subTxID string) (Definition, error) {
 	if def, ok := (*d)[subTxID]; ok {
 		return def, nil
@@ -36,23 +262,52 @@ func (d *Definitions) Get(subTxID string) (Definition, error) {
 	}
 }
 
-func (d *Definitions) Add(subTxID string, action interface{}, compensate interface{}) error {
+func (d *Definitions) Add(subTxID string, action interface{}, compensate interface{}, options ...func(*Definition) error) error {
 	actionFunc, err := validateAndGetFuncValue(action)
 	if err != nil {
 		return errors.Annotatef(err, "invalid action provided for SubTxID: %s", subTxID)
 	}
 
-	compensateFunc, err := validateAndGetFuncValue(compensate)
-	if err != nil {
-		return errors.Annotatef(err, "invalid compensate provided for SubTxID: %s", subTxID)
+	// the compensate is optional for the SubTxs that are never compensated, see validate
+	var compensateFunc reflect.Value
+	if !isNil(compensate) {
+		if compensateFunc, err = validateAndGetFuncValue(compensate); err != nil {
+			return errors.Annotatef(err, "invalid compensate provided for SubTxID: %s", subTxID)
+		}
 	}
 
-	(*d)[subTxID] = Definition{
+	def := Definition{
 		subTxID:    subTxID,
 		action:     actionFunc,
 		compensate: compensateFunc,
 	}
 
+	for _, setter := range options {
+		if err = setter(&def); err != nil {
+			return errors.Annotatef(err, "issue while setting options for SubTxID: %s", subTxID)
+		}
+	}
+
+	if err = def.validate(); err != nil {
+		return errors.Annotatef(err, "invalid options for SubTxID: %s", subTxID)
+	}
+
+	(*d)[subTxID] = def
+
+	return nil
+}
+
+// validate checks that the options set on the definition are consistent with each other.
+func (d *Definition) validate() error {
+	if d.unfinishedPolicy == ProbeUnfinished && !d.statusProbe.IsValid() {
+		return errors.New("unfinished policy ProbeUnfinished needs a status probe")
+	}
+	if d.lockConflictPolicy != FailOnConflict && !d.lockKeys.IsValid() {
+		return errors.New("lock conflict policy needs the lock keys")
+	}
+	if !d.compensate.IsValid() && d.kind != ReadOnly && d.kind != Pivot {
+		return errors.New("compensate must be set, unless the SubTx is ReadOnly or Pivot")
+	}
 	return nil
 }
 
@@ -71,6 +326,12 @@ func validateAndGetFuncValue(obj interface{}) (reflect.Value, error) {
 	return funcValue, nil
 }
 
+// isNil tells if the object is nil, or a nil function.
+func isNil(obj interface{}) bool {
+	v := reflect.ValueOf(obj)
+	return !v.IsValid() || v.Kind() == reflect.Func && v.IsNil()
+}
+
 func isNotAFunction(v reflect.Value) bool {
 	return v.Kind() != reflect.Func
 }
@@ -0,0 +1,74 @@
+package saga
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+func TestActionTimeoutIsAppliedAsDeadline(t *testing.T) {
+	rec := &recorder{}
+	slow := func(c context.Context, amount int, to string) error {
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("credit", slow, rec.action("compensate-credit"),
+		subtx.SetActionTimeout(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	readyTx := tx.New(context.Background(), sagaForTx, memory.NewLogStorage(), "action-timeout")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := readyTx.ExecSubTx("credit", 100, "pam")
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+}
+
+func TestCancelledContextStopsExecutionAndRollback(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	if err := sagaForTx.AddSubTx("debit", rec.action("debit"), rec.failingAction("compensate-debit")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readyTx := tx.New(ctx, sagaForTx, memory.NewLogStorage(), "cancelled-tx")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := readyTx.ExecSubTx("debit", 100, "sam"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	err := readyTx.ExecSubTx("debit", 100, "sam")
+	if errors.Cause(err) != tx.ErrTxCancelled {
+		t.Fatalf("expected ErrTxCancelled, got: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		readyTx.RollbackWithInfiniteTries()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected infinite rollback to stop on cancelled context")
+	}
+}
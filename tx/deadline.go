@@ -0,0 +1,45 @@
+package tx
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrDeadlineExceeded is returned when a SubTx is executed or the Transaction is ended after its deadline.
+// See SetDeadline.
+var ErrDeadlineExceeded = errors.New("transaction deadline exceeded")
+
+// checkDeadline returns ErrDeadlineExceeded if the deadline of the Transaction has passed, and tries rolling back the
+// Transaction once. The rollback is completed by the recovery if it fails, see Recover. The Transaction whose pivot
+// SubTx has ended can only go forward, so the deadline doesn't apply to it.
+func (tx *Tx) checkDeadline(operation string) error {
+	if tx.deadline.IsZero() || time.Now().Before(tx.deadline) {
+		return nil
+	}
+
+	logs, err := tx.getLogs()
+	if err != nil {
+		return errors.Annotate(err, "could not get Tx logs")
+	}
+	pivot, err := tx.pivotIndex(buildSteps(logs))
+	if err != nil {
+		return errors.Annotate(err, "could not find the pivot SubTx")
+	}
+	if pivot >= 0 {
+		return nil
+	}
+
+	tx.log.Info("deadline of TxID: ", tx.txID, " has passed, rolling it back")
+	if rollbackErr := tx.Rollback(1); rollbackErr != nil {
+		tx.log.Error("could not rollback TxID: ", tx.txID, " after its deadline: ", rollbackErr)
+	}
+
+	return errors.Annotatef(ErrDeadlineExceeded, "could not %s TxID: %s, its deadline: %s has passed",
+		operation, tx.txID, tx.deadline.Format(time.RFC3339))
+}
+
+// IsExpired tells if the Transaction with given status has passed its deadline while running, i.e. it must be rolled back.
+func IsExpired(status Status) bool {
+	return status.State == Running && !status.Deadline.IsZero() && time.Now().After(status.Deadline)
+}
@@ -0,0 +1,87 @@
+package tx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/subtx"
+)
+
+// Phase is the phase of the SubTx execution a function is called for.
+type Phase = subtx.Phase
+
+const (
+	// ActionPhase denotes that the action of the SubTx is called.
+	ActionPhase = subtx.ActionPhase
+
+	// CompensatePhase denotes that the compensate of the SubTx is called.
+	CompensatePhase = subtx.CompensatePhase
+
+	// ProbePhase denotes that the status probe of the SubTx is called, see subtx.SetStatusProbe.
+	ProbePhase = subtx.ProbePhase
+)
+
+// ExecInfo describes the SubTx execution an action, compensate or status probe is called for. It's put in the context
+// passed to the function, use ExecInfoFrom to get it. It's immutable, so the functions can't alter each other's view.
+type ExecInfo struct {
+	txID     string
+	sagaName string
+	subTxID  string
+	seq      int
+	attempt  int
+	phase    Phase
+}
+
+// TxID is the ID of the Transaction.
+func (e ExecInfo) TxID() string { return e.txID }
+
+// SagaName is the saga type of the Transaction, if it's set. See SetSagaName.
+func (e ExecInfo) SagaName() string { return e.sagaName }
+
+// SubTxID is the ID of the SubTx.
+func (e ExecInfo) SubTxID() string { return e.subTxID }
+
+// Seq is the position of the SubTx execution in the Transaction, starting at 1.
+func (e ExecInfo) Seq() int { return e.seq }
+
+// Attempt is the attempt of the phase starting at 1, e.g. the compensation pass in the CompensatePhase.
+func (e ExecInfo) Attempt() int { return e.attempt }
+
+// Phase is the phase of the SubTx execution.
+func (e ExecInfo) Phase() Phase { return e.phase }
+
+// IdempotencyKey returns the key that's the same for all the attempts of the phase of the SubTx execution, and
+// unique otherwise, e.g. "order-1:2:action". Pass it downstream so that the retried calls are deduplicated.
+func (e ExecInfo) IdempotencyKey() string {
+	return fmt.Sprintf("%s:%d:%s", e.txID, e.seq, e.phase)
+}
+
+type execInfoKey struct{}
+
+// ExecInfoFrom returns the ExecInfo in the context passed to an action, compensate or status probe.
+func ExecInfoFrom(ctx context.Context) (ExecInfo, bool) {
+	info, ok := ctx.Value(execInfoKey{}).(ExecInfo)
+	return info, ok
+}
+
+// IdempotencyKeyFrom returns the idempotency key of the SubTx execution in the context, or an empty string if the
+// context is not passed by the Transaction. See ExecInfo.IdempotencyKey.
+func IdempotencyKeyFrom(ctx context.Context) string {
+	if info, ok := ExecInfoFrom(ctx); ok {
+		return info.IdempotencyKey()
+	}
+	return ""
+}
+
+// execInfo returns the ExecInfo of the phase of the SubTx execution started with the given log.
+func (tx *Tx) execInfo(start *log.Log, phase Phase, attempt int) ExecInfo {
+	return ExecInfo{
+		txID:     tx.txID,
+		sagaName: tx.name,
+		subTxID:  start.SubTxID,
+		seq:      start.Seq,
+		attempt:  attempt,
+		phase:    phase,
+	}
+}
@@ -0,0 +1,102 @@
+package tx
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/subtx"
+)
+
+// PanicError is the error returned when an action or compensate of a SubTx panics.
+// Use errors.Cause on the error returned by the Transaction to get it.
+type PanicError struct {
+	Value interface{} // Value is the value passed to panic.
+	Stack []byte      // Stack is the stack trace of the panicking goroutine.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// InterceptorProvider is implemented by the Saga that has Interceptors registered, they wrap the calls of the
+// functions of all its SubTxs.
+type InterceptorProvider interface {
+	Interceptors() []subtx.Interceptor
+}
+
+// invoke calls the function of the SubTx for the phase of given ExecInfo with the Transaction context as first argument
+// followed by given arguments. The context carries the ExecInfo of the call. If the timeout of the phase is greater
+// than 0, the context passed to the function is derived with the timeout as deadline. The call is wrapped with the
+// Interceptors of the saga, and then the ones of the SubTx.
+func (tx *Tx) invoke(subTxDef subtx.Definition, info ExecInfo, args []reflect.Value) ([]reflect.Value, error) {
+	fn, timeout := subTxDef.GetAction(), subTxDef.GetActionTimeout()
+	switch info.phase {
+	case CompensatePhase:
+		fn, timeout = subTxDef.GetCompensate(), subTxDef.GetCompensateTimeout()
+	case ProbePhase:
+		fn, timeout = subTxDef.GetStatusProbe(), subTxDef.GetCompensateTimeout()
+	}
+
+	ctx := context.WithValue(tx.ctx, execInfoKey{}, info)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var interceptors []subtx.Interceptor
+	if provider, ok := tx.saga.(InterceptorProvider); ok {
+		interceptors = append(interceptors, provider.Interceptors()...)
+	}
+	interceptors = append(interceptors, subTxDef.GetInterceptors()...)
+
+	handler := func(ctx context.Context, inv subtx.Invocation) ([]reflect.Value, error) {
+		actualArgs := make([]reflect.Value, 0, len(inv.Args)+1)
+		actualArgs = append(actualArgs, reflect.ValueOf(ctx))
+		actualArgs = append(actualArgs, inv.Args...)
+		res := fn.Call(actualArgs)
+		return res, getErrorFrom(res)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, inv subtx.Invocation) ([]reflect.Value, error) {
+			return interceptor(ctx, inv, next)
+		}
+	}
+
+	res, err := call(func() ([]reflect.Value, error) {
+		return handler(ctx, subtx.Invocation{Definition: subTxDef, Phase: info.phase, Args: args})
+	})
+	if err != nil {
+		return res, err
+	}
+
+	// the results may be changed by the Interceptors, the Transaction relies on them matching the function
+	if len(res) != fn.Type().NumOut() {
+		return nil, errors.Errorf("%s of subTxID: %s returned %d results, expected %d",
+			info.phase, info.subTxID, len(res), fn.Type().NumOut())
+	}
+	return res, getErrorFrom(res)
+}
+
+// call calls the function and returns its results along with the error returned by it.
+// If the function panics, the panic is recovered and returned as PanicError.
+func call(fn func() ([]reflect.Value, error)) (res []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return fn()
+}
+
+func getErrorFrom(result []reflect.Value) error {
+	if len(result) == 0 || !result[0].IsValid() || result[0].IsNil() {
+		return nil
+	}
+	return result[0].Interface().(error)
+}
@@ -0,0 +1,179 @@
+package tx
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrLeaseHeld is returned when the lease of the Transaction is held by another owner.
+var ErrLeaseHeld = errors.New("transaction lease is held by another owner")
+
+// ErrFenced is returned when the epoch of the lease is stale, i.e. the lease was acquired by another owner since.
+var ErrFenced = errors.New("transaction lease epoch is stale")
+
+// Lease is the ownership of a Transaction granted by a Leaser. Every grant of the lease of a Transaction has a higher
+// Epoch than the previous grant, so the writes of a previous owner can be fenced.
+type Lease struct {
+	TxID    string
+	Owner   string
+	Epoch   int64
+	Expires time.Time
+}
+
+// Leaser is implemented by the Storage that can grant the ownership of its Transactions, so that only one owner drives
+// a Transaction at a time.
+type Leaser interface {
+	// AcquireLease grants the lease of the Transaction to the owner for ttl with a new epoch, unless it's held by
+	// another owner and not expired, in which case ErrLeaseHeld is returned.
+	AcquireLease(txID, owner string, ttl time.Duration) (Lease, error)
+
+	// RenewLease extends the lease by ttl, it returns ErrFenced if the lease was granted to anyone since.
+	RenewLease(lease Lease, ttl time.Duration) (Lease, error)
+
+	// ReleaseLease gives up the lease, so that it can be acquired by another owner right away.
+	ReleaseLease(lease Lease) error
+
+	// AppendLogFenced appends the log like Storage.AppendLog, if the lease of given epoch is still the latest grant
+	// and it's not released. Otherwise ErrFenced is returned.
+	AppendLogFenced(txID string, epoch int64, data string) error
+}
+
+// SetLease is the functional option to drive the Transaction under a lease granted by the Storage to the owner,
+// the Storage must implement Leaser. The lease is acquired by Start or Resume, or by the first log written otherwise.
+// It's renewed every third of ttl in background, and released by End or once the Transaction is rolled back.
+// The logs are appended with the epoch of the lease, so that an owner that lost the lease can't write them.
+// The renewal stops only when the lease is released or the context of the Transaction is done, so the owner that
+// stops driving the Transaction before it's done must call ReleaseLease, or cancel the context.
+// The ttl must be greater than 0, otherwise the lease can't be acquired.
+func SetLease(owner string, ttl time.Duration) func(*Tx) {
+	return func(tx *Tx) {
+		tx.owner, tx.leaseTTL = owner, ttl
+	}
+}
+
+// acquireLease acquires the lease of the Transaction if it's driven under a lease and doesn't hold it already,
+// and starts renewing it.
+func (tx *Tx) acquireLease() error {
+	if tx.owner == "" {
+		return nil
+	}
+	leaser, ok := tx.storage.(Leaser)
+	if !ok {
+		return errors.New("storage can not grant leases, it must implement tx.Leaser")
+	}
+	if tx.leaseTTL <= 0 {
+		return errors.Errorf("could not acquire lease of TxID: %s, its ttl: %s must be greater than 0", tx.txID, tx.leaseTTL)
+	}
+
+	tx.leaseMu.Lock()
+	defer tx.leaseMu.Unlock()
+	if tx.lease != nil {
+		return nil
+	}
+
+	lease, err := leaser.AcquireLease(tx.txID, tx.owner, tx.leaseTTL)
+	if err != nil {
+		return errors.Annotatef(err, "could not acquire lease of TxID: %s for owner: %s", tx.txID, tx.owner)
+	}
+	tx.lease = &lease
+	tx.stopRenew = make(chan struct{})
+	go tx.renewLease(leaser, tx.stopRenew)
+
+	return nil
+}
+
+// renewLease renews the lease every third of its ttl until it's stopped, the context is done or the lease is fenced.
+func (tx *Tx) renewLease(leaser Leaser, stop chan struct{}) {
+	interval := tx.leaseTTL / 3
+	if interval <= 0 {
+		interval = tx.leaseTTL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tx.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		tx.leaseMu.Lock()
+		if tx.lease == nil {
+			tx.leaseMu.Unlock()
+			return
+		}
+		current := *tx.lease
+		tx.leaseMu.Unlock()
+
+		lease, err := leaser.RenewLease(current, tx.leaseTTL)
+		tx.leaseMu.Lock()
+		if err == nil && tx.lease != nil && tx.lease.Epoch == lease.Epoch {
+			tx.lease = &lease
+		}
+		tx.leaseMu.Unlock()
+
+		if err != nil {
+			tx.log.Error("could not renew lease of TxID: ", tx.txID, " error: ", err)
+			if errors.Cause(err) == ErrFenced {
+				return
+			}
+		}
+	}
+}
+
+// releaseLease stops renewing the lease and releases it, if it's held.
+func (tx *Tx) releaseLease() error {
+	tx.leaseMu.Lock()
+	defer tx.leaseMu.Unlock()
+	if tx.lease == nil {
+		return nil
+	}
+
+	close(tx.stopRenew)
+	lease := *tx.lease
+	tx.lease = nil
+	if err := tx.storage.(Leaser).ReleaseLease(lease); err != nil {
+		return errors.Annotatef(err, "could not release lease of TxID: %s", tx.txID)
+	}
+
+	return nil
+}
+
+// releaseLeaseIfDone releases the lease if the Transaction is committed or rolled back, as there's nothing to drive.
+func (tx *Tx) releaseLeaseIfDone() error {
+	if state := tx.State(); state == Committed || state == Aborted {
+		return tx.releaseLease()
+	}
+	return nil
+}
+
+// ReleaseLease releases the lease of the Transaction, e.g. when the owner stops driving it before it's ended.
+// It must be called to stop renewing the lease of such a Transaction, unless its context is cancelled.
+func (tx *Tx) ReleaseLease() error {
+	return tx.releaseLease()
+}
+
+// appendLog appends the log of the Transaction to the storage, fenced by the epoch of the lease if it's driven
+// under a lease.
+func (tx *Tx) appendLog(data string) error {
+	if tx.owner == "" {
+		return tx.storage.AppendLog(tx.txID, data)
+	}
+	if err := tx.acquireLease(); err != nil {
+		return err
+	}
+
+	tx.leaseMu.Lock()
+	if tx.lease == nil {
+		tx.leaseMu.Unlock()
+		return errors.Annotatef(ErrFenced, "lease of TxID: %s is released", tx.txID)
+	}
+	epoch := tx.lease.Epoch
+	tx.leaseMu.Unlock()
+
+	return tx.storage.(Leaser).AppendLogFenced(tx.txID, epoch, data)
+}
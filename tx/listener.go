@@ -0,0 +1,143 @@
+package tx
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// EventType is the type of a lifecycle event of the Transaction, see Listener.
+type EventType int
+
+const (
+	// EventTxStarted fires once the start of the Transaction is logged, Args is the input of the Transaction.
+	EventTxStarted EventType = iota + 1
+
+	// EventStepStarted fires once an attempt of the SubTx action is logged, before the action is called.
+	EventStepStarted
+
+	// EventStepSucceeded fires once the end of the SubTx action is logged.
+	EventStepSucceeded
+
+	// EventStepFailed fires when an attempt of the SubTx action fails, Err is the failure.
+	EventStepFailed
+
+	// EventCompensationStarted fires once an attempt of the SubTx compensate is logged, before the compensate is called.
+	EventCompensationStarted
+
+	// EventCompensationSucceeded fires once the end of the SubTx compensate is logged.
+	EventCompensationSucceeded
+
+	// EventCompensationFailed fires when an attempt of the SubTx compensate fails, Err is the failure.
+	EventCompensationFailed
+
+	// EventTxCommitted fires once the end of the Transaction is logged.
+	EventTxCommitted
+
+	// EventTxAborted fires once the Transaction is rolled back.
+	EventTxAborted
+
+	// EventLockConflict fires when the SubTx is executed without locking its resources as per subtx.FlagOnConflict
+	// policy, before the SubTx is logged. Err tells the resources locked by another Transaction.
+	EventLockConflict
+)
+
+var eventNames = map[EventType]string{
+	EventTxStarted:             "TxStarted",
+	EventStepStarted:           "StepStarted",
+	EventStepSucceeded:         "StepSucceeded",
+	EventStepFailed:            "StepFailed",
+	EventCompensationStarted:   "CompensationStarted",
+	EventCompensationSucceeded: "CompensationSucceeded",
+	EventCompensationFailed:    "CompensationFailed",
+	EventTxCommitted:           "TxCommitted",
+	EventTxAborted:             "TxAborted",
+	EventLockConflict:          "LockConflict",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Event is a lifecycle event of the Transaction passed to the Listeners.
+type Event struct {
+	Type     EventType
+	TxID     string
+	SagaName string
+	SubTxID  string // SubTxID is empty for the events of the Transaction.
+	Seq      int
+	Attempt  int
+	Args     []interface{} // Args are the decoded arguments of the SubTx, or the input of the Transaction.
+	Err      error         // Err is the failure of the action or compensate, if any.
+	Time     time.Time
+}
+
+// Listener is notified of the lifecycle events of the Transactions, e.g. to publish business events.
+// The events fire after they're logged, and the failures of the Listener are only traced, so they don't affect
+// the Transaction. Register it on the saga, or on a Transaction with SetListeners.
+type Listener interface {
+	OnEvent(e Event) error
+}
+
+// ListenerFunc is the function that's a Listener.
+type ListenerFunc func(e Event) error
+
+// OnEvent calls the function.
+func (f ListenerFunc) OnEvent(e Event) error {
+	return f(e)
+}
+
+// ListenerProvider is implemented by the Saga that has Listeners registered, they're notified of the events
+// of all its Transactions.
+type ListenerProvider interface {
+	Listeners() []Listener
+}
+
+// SetListeners is the functional option to add the Listeners of the Transaction, they're notified after the Listeners
+// of the saga.
+func SetListeners(listeners ...Listener) func(*Tx) {
+	return func(tx *Tx) {
+		tx.listeners = append(tx.listeners, listeners...)
+	}
+}
+
+// emit notifies the Listeners of the saga and the Transaction of the event.
+func (tx *Tx) emit(e Event) {
+	var listeners []Listener
+	if provider, ok := tx.saga.(ListenerProvider); ok {
+		listeners = append(listeners, provider.Listeners()...)
+	}
+	listeners = append(listeners, tx.listeners...)
+	if len(listeners) == 0 {
+		return
+	}
+
+	e.TxID, e.SagaName, e.Time = tx.txID, tx.name, time.Now()
+	for _, l := range listeners {
+		if err := notify(l, e); err != nil {
+			tx.log.Error(fmt.Sprintf("listener failed on event: %s for TxID: %s, error: %v \n", e.Type, tx.txID, err))
+		}
+	}
+}
+
+// notify calls the Listener, the panic of the Listener is recovered and returned as PanicError.
+func notify(l Listener, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+	}()
+	return l.OnEvent(e)
+}
+
+// interfaces returns the values as interfaces, e.g. to pass the decoded arguments in an Event.
+func interfaces(values []reflect.Value) []interface{} {
+	res := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		res = append(res, v.Interface())
+	}
+	return res
+}
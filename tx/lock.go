@@ -0,0 +1,148 @@
+package tx
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/subtx"
+)
+
+// ErrLocked is returned when a resource locked by a SubTx is locked by another Transaction, see subtx.SetLockKeys.
+var ErrLocked = errors.New("resource is locked by another transaction")
+
+// lockPollInterval is the interval at which the locks are tried again as per subtx.WaitOnConflict policy.
+const lockPollInterval = 50 * time.Millisecond
+
+// Locker is implemented by the Storage that keeps the table of the semantic locks on business resources, so that
+// the SubTxs of concurrent Transactions touching the same resources don't interleave. A lock is held by a Transaction
+// until it's released, so it survives the restart of the process and is released by the recovery.
+type Locker interface {
+	// AcquireLocks locks the resources with given keys for the Transaction, either all of them or none. The locks
+	// already held by the Transaction are kept. If any resource is locked by another Transaction, ErrLocked is returned.
+	AcquireLocks(txID string, keys []string) error
+
+	// ReleaseLocks releases all the locks held by the Transaction.
+	ReleaseLocks(txID string) error
+}
+
+// lock locks the resources of the SubTx executed with given arguments as per its lock conflict policy, and returns
+// the keys locked. The SubTxs without lock keys lock nothing.
+func (tx *Tx) lock(subTxDef subtx.Definition, args []interface{}) ([]string, error) {
+	keysFunc := subTxDef.GetLockKeys()
+	if !keysFunc.IsValid() {
+		return nil, nil
+	}
+	subTxID := subTxDef.GetSubTxID()
+	locker, ok := tx.storage.(Locker)
+	if !ok {
+		return nil, errors.Errorf("storage can not lock resources of subTxID: %s, it must implement tx.Locker", subTxID)
+	}
+
+	keysArgs := make([]reflect.Value, 0, len(args))
+	for _, arg := range args {
+		keysArgs = append(keysArgs, reflect.ValueOf(arg))
+	}
+	var keys []string
+	if _, err := call(func() ([]reflect.Value, error) {
+		keys = keysFunc.Call(keysArgs)[0].Interface().([]string)
+		return nil, nil
+	}); err != nil {
+		return nil, errors.Annotatef(err, "could not get lock keys of subTxID: %s", subTxID)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// the intent is logged before the locks are acquired, so that they're released even if the process dies before
+	// the SubTx is logged
+	logMsg := &log.Log{
+		Type:    log.LockSubTx,
+		SubTxID: subTxID,
+		Time:    time.Now(),
+		Locks:   keys,
+	}
+	l, err := marshal.Marshal(logMsg)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not marshal log message for lock of SubTx")
+	}
+	if err := tx.appendLog(l); err != nil {
+		return nil, errors.Annotate(err, "could not append lock SubTx log for subTxID: "+subTxID)
+	}
+	tx.mu.Lock()
+	tx.locked = true
+	tx.mu.Unlock()
+
+	for {
+		err := locker.AcquireLocks(tx.txID, keys)
+		if err == nil {
+			return keys, nil
+		}
+		if errors.Cause(err) != ErrLocked {
+			return nil, errors.Annotatef(err, "could not lock %v for subTxID: %s", keys, subTxID)
+		}
+
+		switch subTxDef.GetLockConflictPolicy() {
+		case subtx.FlagOnConflict:
+			tx.log.Info(fmt.Sprintf("executing SubTxID: %s without locks, error: %v \n", subTxID, err))
+			tx.emit(Event{Type: EventLockConflict, SubTxID: subTxID, Args: args, Err: err})
+			return nil, nil
+		case subtx.WaitOnConflict:
+			if !tx.deadline.IsZero() && time.Now().Add(lockPollInterval).After(tx.deadline) {
+				return nil, errors.Annotatef(err, "could not lock %v for subTxID: %s before the deadline", keys, subTxID)
+			}
+			if err := tx.wait(lockPollInterval); err != nil {
+				return nil, errors.Annotatef(err, "could not lock %v for subTxID: %s", keys, subTxID)
+			}
+		default:
+			return nil, errors.Annotatef(err, "could not lock %v for subTxID: %s", keys, subTxID)
+		}
+	}
+}
+
+// releaseLocks releases the locks held by the Transaction, if any. The locks taken before the Transaction was resumed
+// are known from the logs, see hasLocks.
+func (tx *Tx) releaseLocks() error {
+	tx.mu.Lock()
+	locked := tx.locked
+	tx.mu.Unlock()
+	if !locked {
+		return nil
+	}
+
+	locker, ok := tx.storage.(Locker)
+	if !ok {
+		return errors.New("storage can not release locks, it must implement tx.Locker")
+	}
+	if err := locker.ReleaseLocks(tx.txID); err != nil {
+		return errors.Annotatef(err, "could not release locks of TxID: %s", tx.txID)
+	}
+
+	tx.mu.Lock()
+	tx.locked = false
+	tx.mu.Unlock()
+	return nil
+}
+
+// releaseLocksAndLease releases the locks and the lease held by the Transaction once it's done. The lease is released
+// even if the locks could not be.
+func (tx *Tx) releaseLocksAndLease() error {
+	lockErr := tx.releaseLocks()
+	if err := tx.releaseLease(); err != nil {
+		return err
+	}
+	return lockErr
+}
+
+// hasLocks tells if the logs show the intent to lock resources, or a SubTx execution that locked them.
+func hasLocks(logs []log.Log) bool {
+	for _, l := range logs {
+		if (l.Type == log.LockSubTx || l.Type == log.StartSubTx) && len(l.Locks) > 0 {
+			return true
+		}
+	}
+	return false
+}
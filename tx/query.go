@@ -0,0 +1,120 @@
+package tx
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+)
+
+// QueryableStorage is implemented by the Storage that can find the Transactions it keeps,
+// e.g. for recovery tooling, dashboards and cleanup jobs.
+type QueryableStorage interface {
+	Storage
+	TxLister
+
+	// QueryTxIDs returns a page of the IDs of the Transactions that match the query, in sorted order.
+	QueryTxIDs(q Query) (Page, error)
+
+	// GetLastLog returns the latest log of the Transaction without reading all of its logs.
+	GetLastLog(id string) (string, error)
+}
+
+// Query filters and paginates the Transactions listed by QueryableStorage. The zero Query matches all the Transactions.
+type Query struct {
+	// States matches the Transactions in any of the given states, as derived by DeriveState. Empty matches any state.
+	States []State
+
+	// StartedAfter and StartedBefore match the Transactions started within the range, the zero time leaves
+	// the range open. The Transactions that are not started don't match a range.
+	StartedAfter  time.Time
+	StartedBefore time.Time
+
+	// After is the TxID after which the page starts, i.e. the Next of the previous Page. Empty starts from the first TxID.
+	After string
+
+	// Limit is the maximum number of TxIDs in the page. 0 means no limit.
+	Limit int
+}
+
+// Page is a page of TxIDs returned by QueryableStorage.
+type Page struct {
+	TxIDs []string
+
+	// Next is the After of the Query for the next page, it's empty if there are no more TxIDs.
+	Next string
+}
+
+// NeedsLogs tells if the logs of a Transaction are needed to match it, i.e. the Query filters by State or start time.
+func (q Query) NeedsLogs() bool {
+	return len(q.States) > 0 || !q.StartedAfter.IsZero() || !q.StartedBefore.IsZero()
+}
+
+// Matches tells if the Transaction with given logs matches the filters of the Query.
+func (q Query) Matches(logs []log.Log) bool {
+	if len(q.States) > 0 {
+		state, found := DeriveState(logs), false
+		for _, s := range q.States {
+			if s == state {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.StartedAfter.IsZero() && q.StartedBefore.IsZero() {
+		return true
+	}
+
+	var started time.Time
+	for _, l := range logs {
+		if l.Type == log.StartTx {
+			started = l.Time
+		}
+	}
+	if started.IsZero() {
+		return false
+	}
+
+	return (q.StartedAfter.IsZero() || started.After(q.StartedAfter)) &&
+		(q.StartedBefore.IsZero() || started.Before(q.StartedBefore))
+}
+
+// FilterPage returns the page of given TxIDs that match the Query, the logs of each TxID are read with getLogs only if
+// the Query needs them. It helps the Storage implementations of QueryTxIDs.
+func FilterPage(ids []string, q Query, getLogs func(id string) ([]string, error)) (Page, error) {
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+
+	var page Page
+	for _, id := range ids {
+		if id <= q.After {
+			continue
+		}
+		if q.Limit > 0 && len(page.TxIDs) == q.Limit {
+			page.Next = page.TxIDs[len(page.TxIDs)-1]
+			break
+		}
+
+		if q.NeedsLogs() {
+			raw, err := getLogs(id)
+			if err != nil {
+				return page, errors.Annotatef(err, "could not get logs of TxID: %s", id)
+			}
+			logs, err := ParseLogs(raw)
+			if err != nil {
+				return page, errors.Annotatef(err, "could not parse logs of TxID: %s", id)
+			}
+			if !q.Matches(logs) {
+				continue
+			}
+		}
+		page.TxIDs = append(page.TxIDs, id)
+	}
+
+	return page, nil
+}
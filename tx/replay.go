@@ -0,0 +1,94 @@
+package tx
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/subtx"
+)
+
+// ErrReplayMismatch is returned in replay mode when the SubTx executed at a position differs from the SubTx logged
+// at the same position, i.e. the code executing the Transaction is not deterministic. See SetReplay.
+var ErrReplayMismatch = errors.New("sub-transaction does not match the logged execution")
+
+// SetReplay is the functional option to replay the logged SubTx executions when the Transaction is resumed, either by
+// Resume or by Start with ResumeReused policy. The SubTxs are matched with the logged executions by their position,
+// so the SubTxs must be executed in the same order with the same arguments, i.e. one at a time. An execution that
+// is logged as ended returns the logged results without calling the action, an unfinished one continues its attempts.
+// The SubTxs executed after the logged ones are executed as usual.
+func SetReplay() func(*Tx) {
+	return func(tx *Tx) {
+		tx.replay = true
+	}
+}
+
+// recordedStep returns the logged execution at given Seq, if the Transaction is replayed.
+func (tx *Tx) recordedStep(seq int) (*step, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	s, ok := tx.recorded[seq]
+	return s, ok
+}
+
+// continued takes the logged execution of the SubTx with the same arguments that never ended, if the Transaction is
+// resumed. Executing it again continues its Seq and attempts, so e.g. its idempotency key stays the same.
+func (tx *Tx) continued(subTxID string, args []log.ArgData) (*step, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for i, s := range tx.pending {
+		if s.start.SubTxID == subTxID && sameArgs(s.start.Args, args) {
+			tx.pending = append(tx.pending[:i:i], tx.pending[i+1:]...)
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// replayed returns the recorded results of the logged execution if it's ended, as they were returned by the action.
+// Otherwise the start log continues the attempts of the logged execution.
+func (tx *Tx) replayed(subTxDef subtx.Definition, logMsg *log.Log) ([]reflect.Value, bool, error) {
+	s, ok := tx.recordedStep(logMsg.Seq)
+	if !ok {
+		return nil, false, nil
+	}
+	if s.start.SubTxID != logMsg.SubTxID || !sameArgs(s.start.Args, logMsg.Args) {
+		return nil, true, errors.Annotatef(ErrReplayMismatch, "could not replay subTxID: %s at seq: %d, the logged subTxID is: %s",
+			logMsg.SubTxID, logMsg.Seq, s.start.SubTxID)
+	}
+	if !s.ended {
+		logMsg.Attempt = s.start.Attempt
+		return nil, false, nil
+	}
+
+	results, err := tx.saga.UnmarshallArgs(s.start.Results)
+	if err != nil {
+		return nil, true, errors.Annotatef(err, "could not unmarshall results of subTxID: %s", logMsg.SubTxID)
+	}
+
+	// the error is nil, the results missing from the logs are zero
+	actionType := subTxDef.GetAction().Type()
+	res := make([]reflect.Value, 0, actionType.NumOut())
+	res = append(res, reflect.Zero(actionType.Out(0)))
+	res = append(res, results...)
+	for i := len(res); i < actionType.NumOut(); i++ {
+		res = append(res, reflect.Zero(actionType.Out(i)))
+	}
+
+	tx.log.Info(fmt.Sprintf("replayed SubTxID: %s, seq: %d \n", logMsg.SubTxID, logMsg.Seq))
+	return res, true, nil
+}
+
+// sameArgs tells if the marshalled arguments are the same.
+func sameArgs(a, b []log.ArgData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
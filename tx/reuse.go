@@ -0,0 +1,26 @@
+package tx
+
+import "github.com/juju/errors"
+
+// ErrTxIDInUse is returned by Start when the TxID is already in use and the ReusePolicy doesn't allow reusing it.
+var ErrTxIDInUse = errors.New("transaction id is already in use")
+
+// ReusePolicy decides what Start does when the TxID is already in use, e.g. when a request is retried with the same
+// idempotency key.
+type ReusePolicy int
+
+const (
+	// IdempotentReused treats the committed Transaction as an idempotent success, i.e. Start returns no error and the
+	// Transaction is in Committed state, see State. Otherwise Start returns ErrTxIDInUse. It's the default policy.
+	IdempotentReused ReusePolicy = iota + 1
+
+	// RejectReused returns ErrTxIDInUse from Start whatever the state of the Transaction is.
+	RejectReused
+
+	// ResumeReused resumes the Transaction from its logs, see Resume. The Transaction continues in the state derived
+	// from the logs, e.g. an ended Transaction is in Committed state and can't execute SubTxs.
+	ResumeReused
+
+	// RollbackReused rolls back the Transaction once, even if it's committed, and starts it over.
+	RollbackReused
+)
@@ -0,0 +1,203 @@
+package tx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/retry"
+	"github.com/vkaushik/saga/subtx"
+)
+
+// ErrPivotPassed is returned by rollback when the pivot SubTx of the Transaction has ended,
+// the Transaction can't be rolled back and must be recovered forward. See Recover.
+var ErrPivotPassed = errors.New("transaction passed its pivot sub-transaction")
+
+// ErrCompensationFailed is returned when the rollback strategy gives up rolling back the Transaction.
+// The Transaction is marked with CompensationFailedTx log, so that operators can act on it.
+var ErrCompensationFailed = errors.New("transaction compensation failed")
+
+// RollbackStrategy decides how the failed rollback of a Transaction is retried.
+type RollbackStrategy struct {
+	// Backoff computes the delay before each retry of the rollback.
+	Backoff retry.Backoff
+
+	// MaxAttempts is the maximum number of rollback attempts. 0 means no limit.
+	MaxAttempts int
+
+	// MaxDuration is the maximum duration for which the rollback is retried. 0 means no limit.
+	MaxDuration time.Duration
+
+	// OnAttempt is called after every rollback attempt with the attempt number starting at 1,
+	// and the error of the attempt or nil if the rollback is successful.
+	OnAttempt func(attempt int, err error)
+}
+
+// DefaultRollbackStrategy returns the strategy that retries the rollback with exponential backoff
+// until it's successful or the Transaction context is cancelled.
+func DefaultRollbackStrategy() RollbackStrategy {
+	return RollbackStrategy{
+		Backoff: retry.DefaultBackoff(),
+	}
+}
+
+// givesUp tells if the strategy gives up after the given failed attempt, if the next attempt would be made after
+// the delay since the rollback started.
+func (s RollbackStrategy) givesUp(attempt int, started time.Time, delay time.Duration) bool {
+	if s.MaxAttempts > 0 && attempt >= s.MaxAttempts {
+		return true
+	}
+	// the delay may be as long as the longest Duration, see retry.Backoff
+	elapsed := time.Since(started)
+	return s.MaxDuration > 0 && (delay > s.MaxDuration || elapsed > s.MaxDuration-delay)
+}
+
+// RollbackWithStrategy tries rolling back the transaction, and retries the failed rollback as per the strategy.
+// It stops with ErrTxCancelled if the Transaction context is cancelled, or ErrIllegalTransition if the Transaction
+// is committed. If the strategy gives up, the Transaction
+// is marked with CompensationFailedTx log and ErrCompensationFailed is returned.
+func (tx *Tx) RollbackWithStrategy(strategy RollbackStrategy) error {
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		tx.log.Info("rollback attempt: ", attempt, " for tx: ", tx.txID)
+		err := tx.rollback(false)
+		if strategy.OnAttempt != nil {
+			strategy.OnAttempt(attempt, err)
+		}
+		if err == nil {
+			return nil
+		}
+		if isTerminal(err) {
+			return err
+		}
+
+		delay := strategy.Backoff.Delay(attempt)
+		if strategy.givesUp(attempt, started, delay) {
+			if logErr := tx.markCompensationFailed(err); logErr != nil {
+				return errors.Annotatef(logErr, "could not mark compensation failed after: %v", err)
+			}
+			tx.setState(CompensationFailed)
+			return errors.Annotatef(ErrCompensationFailed, "gave up rolling back tx: %s after %d attempts, last error: %v", tx.txID, attempt, err)
+		}
+
+		if err := tx.wait(delay); err != nil {
+			return errors.Annotate(err, "could not retry rollback")
+		}
+	}
+}
+
+// isTerminal tells if the rollback failed with an error that retrying can't fix, e.g. the Transaction is committed.
+func isTerminal(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrTxCancelled || cause == ErrPivotPassed || cause == ErrIllegalTransition
+}
+
+// RecoveryMode is the way a failed Transaction is recovered.
+type RecoveryMode int
+
+const (
+	// BackwardRecovery rolls back the Transaction by compensating the executed SubTxs.
+	BackwardRecovery RecoveryMode = iota + 1
+
+	// ForwardRecovery retries the unfinished SubTxs executed after the pivot SubTx until they're successful.
+	ForwardRecovery
+)
+
+// Recover recovers the failed Transaction. If the logs show that a pivot SubTx has ended, the Transaction can only
+// go forward, so the unfinished SubTxs executed after the pivot are retried until they're successful, the caller
+// must then execute the remaining SubTxs. Otherwise, the Transaction is rolled back with DefaultRollbackStrategy.
+// Both modes stop with ErrTxCancelled when the Transaction context is cancelled.
+func (tx *Tx) Recover() (RecoveryMode, error) {
+	return tx.RecoverWithStrategy(DefaultRollbackStrategy())
+}
+
+// RecoverWithStrategy recovers the failed Transaction like Recover, the backward recovery is retried as per the strategy.
+func (tx *Tx) RecoverWithStrategy(strategy RollbackStrategy) (RecoveryMode, error) {
+	if err := tx.restoreState(); err != nil {
+		return 0, errors.Annotate(err, "could not recover")
+	}
+	if err := tx.checkState("recover", NotStarted, Running, Aborting, CompensationFailed, Aborted); err != nil {
+		return 0, err
+	}
+
+	logs, err := tx.getLogs()
+	if err != nil {
+		return 0, errors.Annotate(err, "could not get Tx logs")
+	}
+
+	steps := buildSteps(logs)
+	pivot, err := tx.pivotIndex(steps)
+	if err != nil {
+		return 0, errors.Annotate(err, "could not find the pivot SubTx")
+	}
+	if pivot < 0 {
+		return BackwardRecovery, tx.RollbackWithStrategy(strategy)
+	}
+
+	for _, s := range steps[pivot+1:] {
+		if s.ended {
+			continue
+		}
+
+		subTxDef, err := tx.saga.GetSubTxDef(s.start.SubTxID)
+		if err != nil {
+			return ForwardRecovery, errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", s.start.SubTxID)
+		}
+
+		values, err := tx.saga.UnmarshallArgs(s.start.Args)
+		if err != nil {
+			return ForwardRecovery, errors.Annotatef(err, "could not unmarshall arguments of subTxID: %s", s.start.SubTxID)
+		}
+		args := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			args = append(args, v.Interface())
+		}
+
+		tx.log.Info(fmt.Sprintf("recovering forward SubTxID: %s, seq: %d \n", s.start.SubTxID, s.start.Seq))
+		logMsg := s.start
+		if _, err := tx.execSubTx(subTxDef, &logMsg, args, true); err != nil {
+			return ForwardRecovery, errors.Annotatef(err, "could not recover forward subTxID: %s", s.start.SubTxID)
+		}
+	}
+
+	return ForwardRecovery, nil
+}
+
+// pivotIndex returns the index of the last ended pivot SubTx execution, or -1 if no pivot SubTx has ended.
+func (tx *Tx) pivotIndex(steps []*step) (int, error) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if !steps[i].ended {
+			continue
+		}
+		subTxDef, err := tx.saga.GetSubTxDef(steps[i].start.SubTxID)
+		if err != nil {
+			return -1, errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", steps[i].start.SubTxID)
+		}
+		if subTxDef.GetKind() == subtx.Pivot {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// markCompensationFailed appends the CompensationFailedTx log with the reason of the failure.
+func (tx *Tx) markCompensationFailed(failure error) error {
+	logMsg := &log.Log{
+		Type:  log.CompensationFailedTx,
+		Time:  time.Now(),
+		Error: failure.Error(),
+	}
+
+	l, err := marshal.Marshal(logMsg)
+	if err != nil {
+		return errors.Annotate(err, "could not marshal compensation failed Tx log message")
+	}
+
+	if err = tx.appendLog(l); err != nil {
+		return errors.Annotate(err, "could not log compensation failed Tx log message")
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package tx
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+)
+
+// ErrIllegalTransition is returned when an operation is not allowed in the current state of the Transaction,
+// e.g. ExecSubTx after End or End after an abort.
+var ErrIllegalTransition = errors.New("illegal transaction state transition")
+
+// State is the state of a Transaction, derived from its logs.
+type State int
+
+const (
+	// NotStarted denotes that the Transaction has no logs.
+	NotStarted State = iota + 1
+
+	// Running denotes that the Transaction is started and executing SubTxs.
+	Running
+
+	// Committed denotes that the Transaction is ended.
+	Committed
+
+	// Aborting denotes that the Transaction is being rolled back.
+	Aborting
+
+	// Aborted denotes that the Transaction is rolled back.
+	Aborted
+
+	// CompensationFailed denotes that the rollback of the Transaction was given up, see RollbackWithStrategy.
+	CompensationFailed
+)
+
+var stateNames = map[State]string{
+	NotStarted:         "NotStarted",
+	Running:            "Running",
+	Committed:          "Committed",
+	Aborting:           "Aborting",
+	Aborted:            "Aborted",
+	CompensationFailed: "CompensationFailed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// StepState is the state of a single SubTx execution, derived from the Transaction logs.
+type StepState int
+
+const (
+	// StepRunning denotes that the action is started and has not returned yet.
+	StepRunning StepState = iota + 1
+
+	// StepFailed denotes that the last attempt of the action failed.
+	StepFailed
+
+	// StepDone denotes that the action has ended.
+	StepDone
+
+	// StepCompensating denotes that the compensate is started and has not returned yet.
+	StepCompensating
+
+	// StepCompensated denotes that the compensate has ended.
+	StepCompensated
+
+	// StepCompensationFailed denotes that the last attempt of the compensate failed.
+	StepCompensationFailed
+)
+
+var stepStateNames = map[StepState]string{
+	StepRunning:            "Running",
+	StepFailed:             "Failed",
+	StepDone:               "Done",
+	StepCompensating:       "Compensating",
+	StepCompensated:        "Compensated",
+	StepCompensationFailed: "CompensationFailed",
+}
+
+func (s StepState) String() string {
+	if name, ok := stepStateNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Status is the state of a Transaction and of each of its SubTx executions, derived from its logs.
+type Status struct {
+	TxID  string
+	Name  string // Name is the saga type of the Transaction.
+	State State
+	Input []log.ArgData
+	Steps []StepStatus
+
+	StartedAt time.Time // StartedAt is the time of the start of the Transaction.
+	UpdatedAt time.Time // UpdatedAt is the time of the last log of the Transaction.
+	Deadline  time.Time // Deadline is the time by which the Transaction must finish, if it's set. See SetDeadline.
+}
+
+// StepStatus is the state of a single SubTx execution, derived from the Transaction logs.
+type StepStatus struct {
+	SubTxID string
+	Seq     int
+	Attempt int
+	State   StepState
+	Args    []log.ArgData
+	Results []log.ArgData
+	Error   string // Error is the message of the last failure of the action or compensate.
+}
+
+// Status reads the Transaction logs and returns the state of the Transaction and of each of its SubTx executions.
+func (tx *Tx) Status() (Status, error) {
+	logs, err := tx.getLogs()
+	if err != nil {
+		return Status{}, errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+	}
+
+	status := Status{TxID: tx.txID, State: DeriveState(logs)}
+	for _, l := range logs {
+		if l.Type == log.StartTx {
+			status.Name, status.Input, status.StartedAt, status.Deadline = l.Name, l.Args, l.Time, time.Time{}
+			if l.Deadline != nil {
+				status.Deadline = *l.Deadline
+			}
+		}
+		status.UpdatedAt = l.Time
+	}
+
+	for _, s := range buildSteps(logs) {
+		status.Steps = append(status.Steps, StepStatus{
+			SubTxID: s.start.SubTxID,
+			Seq:     s.start.Seq,
+			Attempt: s.start.Attempt,
+			State:   s.state(),
+			Args:    s.start.Args,
+			Results: s.start.Results,
+			Error:   s.failure,
+		})
+	}
+
+	return status, nil
+}
+
+// DeriveState derives the state of the Transaction from its logs, it helps the Storage implementations to filter by State.
+func DeriveState(logs []log.Log) State {
+	state := NotStarted
+	for _, l := range logs {
+		switch l.Type {
+		case log.StartTx:
+			state = Running
+		case log.EndTx:
+			state = Committed
+		case log.AbortTx:
+			state = Aborting
+		case log.AbortedTx:
+			state = Aborted
+		case log.CompensationFailedTx:
+			state = CompensationFailed
+		case log.StartSubTx:
+			// SubTxs executed without starting the Transaction
+			if state == NotStarted {
+				state = Running
+			}
+		}
+	}
+	return state
+}
+
+// checkState returns ErrIllegalTransition if the operation is not allowed in the current state of the Transaction.
+func (tx *Tx) checkState(operation string, allowed ...State) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	for _, s := range allowed {
+		if tx.state == s {
+			return nil
+		}
+	}
+	return errors.Annotatef(ErrIllegalTransition, "could not %s TxID: %s in state: %s", operation, tx.txID, tx.state)
+}
+
+// restoreState restores the state of the Transaction from its logs before the first operation of this Tx, unless
+// it's started or resumed, so that e.g. the new Tx of a committed TxID can't execute SubTxs.
+func (tx *Tx) restoreState() error {
+	tx.restoreMu.Lock()
+	defer tx.restoreMu.Unlock()
+	if tx.restored || tx.State() != NotStarted {
+		return nil
+	}
+
+	logs, err := tx.getLogs()
+	if err != nil {
+		return errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+	}
+	if len(logs) > 0 {
+		if err := tx.resume(); err != nil {
+			return err
+		}
+	}
+	tx.restored = true
+	return nil
+}
+
+// State returns the state of the Transaction as known to this Tx, e.g. Committed if Start found the TxID committed.
+// Use Status to derive the state from the logs.
+func (tx *Tx) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.state
+}
+
+// setState moves the Transaction to the given state.
+func (tx *Tx) setState(s State) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.state = s
+}
+
+// checkLoggedState returns ErrIllegalTransition if the logs show the Transaction in a state other than the allowed ones,
+// e.g. when the recovery has aborted it while this Tx was executing a SubTx. This Tx moves to the logged state then.
+func (tx *Tx) checkLoggedState(operation string, allowed ...State) error {
+	logs, err := tx.getLogs()
+	if err != nil {
+		return errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+	}
+
+	state := DeriveState(logs)
+	for _, s := range allowed {
+		if state == s {
+			return nil
+		}
+	}
+	tx.setState(state)
+	return errors.Annotatef(ErrIllegalTransition, "could not %s TxID: %s, it's moved to state: %s meanwhile", operation, tx.txID, state)
+}
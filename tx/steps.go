@@ -0,0 +1,138 @@
+package tx
+
+import (
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/log"
+	"github.com/vkaushik/saga/marshal"
+)
+
+// step is the state of a single SubTx execution, rebuilt from the Tx logs.
+type step struct {
+	start            log.Log // the StartSubTx log of this execution
+	ended            bool
+	failed           bool // the last attempt of the action failed
+	compensating     bool
+	compensated      bool
+	compensateFailed bool   // the last attempt of the compensate failed
+	compensations    int    // the number of attempts of the compensate
+	failure          string // the error message of the last failure of the action or compensate
+}
+
+// state returns the state of the SubTx execution.
+func (s *step) state() StepState {
+	switch {
+	case s.compensated:
+		return StepCompensated
+	case s.compensateFailed:
+		return StepCompensationFailed
+	case s.compensating:
+		return StepCompensating
+	case s.ended:
+		return StepDone
+	case s.failed:
+		return StepFailed
+	default:
+		return StepRunning
+	}
+}
+
+// getLogs fetches the Tx logs from storage and unmarshalls them.
+func (tx *Tx) getLogs() ([]log.Log, error) {
+	logs, err := tx.storage.GetTxLogs(tx.txID)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not get Tx logs from storage")
+	}
+
+	return ParseLogs(logs)
+}
+
+// ParseLogs unmarshalls the Tx logs as kept in the Storage.
+func ParseLogs(logs []string) ([]log.Log, error) {
+	res := make([]log.Log, 0, len(logs))
+	for _, logBytes := range logs {
+		var logData log.Log
+		if err := marshal.Unmarshal([]byte(logBytes), &logData); err != nil {
+			return nil, errors.Annotate(err, "could not unmarshal log data")
+		}
+		res = append(res, logData)
+	}
+
+	return res, nil
+}
+
+// buildSteps rebuilds the state of each SubTx execution from the Tx logs, in the order of execution.
+// Logs written without a Seq are matched with the latest execution of the same SubTxID.
+func buildSteps(logs []log.Log) []*step {
+	var steps []*step
+	bySeq := map[int]*step{}
+
+	find := func(l log.Log) *step {
+		if l.Seq != 0 {
+			return bySeq[l.Seq]
+		}
+		for i := len(steps) - 1; i >= 0; i-- {
+			if steps[i].start.SubTxID == l.SubTxID {
+				return steps[i]
+			}
+		}
+		return nil
+	}
+
+	for _, l := range logs {
+		if s, ok := bySeq[l.Seq]; ok && l.Type == log.StartSubTx {
+			// another attempt of the same execution
+			s.start.Attempt = l.Attempt
+			s.failed = false
+			continue
+		}
+		if l.Type == log.StartSubTx {
+			if l.Seq == 0 {
+				l.Seq = len(steps) + 1
+			}
+			s := &step{start: l}
+			steps = append(steps, s)
+			bySeq[l.Seq] = s
+			continue
+		}
+
+		s := find(l)
+		if s == nil {
+			continue
+		}
+		switch l.Type {
+		case log.EndSubTx:
+			// the compensations logged before EndCompensateSubTx was used end with EndSubTx
+			if s.compensating {
+				s.compensated = true
+				continue
+			}
+			s.ended = true
+			s.start.Results = l.Results
+		case log.StartCompensateSubTx:
+			s.compensating = true
+			s.compensations++
+			s.compensateFailed = false
+		case log.EndCompensateSubTx:
+			s.compensated = true
+		case log.FailSubTx:
+			s.failed = true
+			s.failure = l.Error
+		case log.FailCompensateSubTx:
+			s.compensateFailed = true
+			s.failure = l.Error
+		}
+	}
+
+	return steps
+}
+
+// lastSeq returns the highest Seq used by the SubTx executions in the logs.
+func lastSeq(steps []*step) int {
+	seq := 0
+	for _, s := range steps {
+		if s.start.Seq > seq {
+			seq = s.start.Seq
+		}
+	}
+	return seq
+}
@@ -4,15 +4,21 @@ import (
 	"context"
 	"fmt"
 	"github.com/vkaushik/saga/marshal"
+	"github.com/vkaushik/saga/retry"
 	"github.com/vkaushik/saga/subtx"
 	"github.com/vkaushik/saga/trace"
 	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/vkaushik/saga/log"
 )
 
+// ErrTxCancelled is returned when the Transaction context is cancelled, no more SubTxs are executed or compensated after it.
+var ErrTxCancelled = errors.New("transaction context is cancelled")
+
 // Tx is the Transaction object to perfrom sub-transactions in the Saga
 type Tx struct {
 	ctx     context.Context
@@ -20,6 +26,35 @@ type Tx struct {
 	saga    Saga
 	storage Storage
 	log     trace.Logger
+	name    string        // name is the saga type of this transaction, it's logged with the start of transaction.
+	input   []interface{} // input of this transaction, it's logged with the start of transaction.
+
+	mu    sync.Mutex // mu guards seq and state, as SubTxs can be executed in parallel.
+	seq   int        // seq is the Seq of the last SubTx execution in this transaction.
+	state State      // state of this transaction, it guards against the illegal transitions.
+
+	restoreMu sync.Mutex // restoreMu guards restored, see restoreState.
+	restored  bool       // restored tells if the state is restored from the logs by the first operation.
+
+	reuse ReusePolicy // reuse decides what Start does when the TxID is already in use.
+
+	unfinished subtx.UnfinishedPolicy // unfinished is the unfinished policy of the SubTxs that don't set their own.
+
+	deadline time.Time // deadline by which the Transaction must finish, it's logged with the start of transaction.
+
+	replay   bool          // replay the logged SubTx executions when the Transaction is resumed, see SetReplay.
+	recorded map[int]*step // recorded are the logged SubTx executions to replay, by Seq.
+	pending  []*step       // pending are the logged SubTx executions that never ended, see continued.
+
+	listeners []Listener // listeners of this transaction, see SetListeners.
+
+	locked bool // locked tells if the Transaction may hold the locks of resources, see Locker. It's guarded by mu.
+
+	owner     string        // owner drives the Transaction under the lease of storage, see SetLease.
+	leaseTTL  time.Duration // leaseTTL is the duration for which the lease is acquired and renewed.
+	leaseMu   sync.Mutex    // leaseMu guards lease and stopRenew, as the lease is renewed in background.
+	lease     *Lease
+	stopRenew chan struct{}
 }
 
 // Saga is the dependency for Transaction that keeps Sub-Transaction definitions.
@@ -36,45 +71,151 @@ type Storage interface {
 	GetTxLogs(id string) ([]string, error)
 }
 
+// TxLister is implemented by the Storage that can enumerate the Transactions it keeps, e.g. for recovery.
+type TxLister interface {
+	ListTxIDs() ([]string, error)
+}
+
 // ReadyTx is the Ready-Transaction that exposes the executable actions for the Saga Transaction
 type ReadyTx interface {
 	Start() error
+	Resume() error
 	ExecSubTx(subTxID string, args ...interface{}) error
 	ExecSubTxAndGetResult(subTxID string, args ...interface{}) ([]reflect.Value, error)
 	End() error
 	SetLogger(l trace.Logger)
 	SetContext(ctx context.Context)
 	RollbackWithInfiniteTries()
+	RollbackWithStrategy(strategy RollbackStrategy) error
 	Rollback(tryCount int) error
+	Recover() (RecoveryMode, error)
+	RecoverWithStrategy(strategy RollbackStrategy) (RecoveryMode, error)
+	Status() (Status, error)
+	State() State
+	ReleaseLease() error
 	IsTxIDAlreadyInUse() (bool, error)
 }
 
-// New returns an instance of type ReadyTx
-func New(ctx context.Context, sg Saga, st Storage, txID string) ReadyTx {
+// New returns an instance of type ReadyTx. It accepts functional options to customize the Transaction.
+func New(ctx context.Context, sg Saga, st Storage, txID string, options ...func(*Tx)) ReadyTx {
+
+	return NewWithLogger(ctx, sg, st, txID, trace.NewDummyLogger(), options...)
+}
+
+// NewWithLogger returns an instance of type ReadyTx with given logger. It accepts functional options to customize the Transaction.
+func NewWithLogger(ctx context.Context, sg Saga, st Storage, txID string, logger trace.Logger, options ...func(*Tx)) ReadyTx {
+	tx := &Tx{ctx: ctx, saga: sg, storage: st, txID: txID, log: logger, state: NotStarted, reuse: IdempotentReused}
+	for _, setter := range options {
+		setter(tx)
+	}
+
+	return tx
+}
 
-	return NewWithLogger(ctx, sg, st, txID, trace.NewDummyLogger())
+// SetSagaName is the functional option to set the saga type of the Transaction, it's logged with the start of Transaction.
+func SetSagaName(name string) func(*Tx) {
+	return func(tx *Tx) {
+		tx.name = name
+	}
 }
 
-// NewWithLogger returns an instance of type ReadyTx with given logger
-func NewWithLogger(ctx context.Context, sg Saga, st Storage, txID string, logger trace.Logger) ReadyTx {
+// SetInput is the functional option to set the input of the Transaction, it's logged with the start of Transaction
+// so that the Transaction can be resumed. The types of input must be registered in saga, i.e. accepted by a SubTx.
+func SetInput(input ...interface{}) func(*Tx) {
+	return func(tx *Tx) {
+		tx.input = input
+	}
+}
 
-	return &Tx{ctx: ctx, saga: sg, storage: st, txID: txID, log: logger}
+// SetDeadline is the functional option to set the time by which the Transaction must finish, it's logged with the start
+// of Transaction. Once it passes, the SubTxs are refused with ErrDeadlineExceeded and the Transaction is rolled back,
+// unless its pivot SubTx has ended. See checkDeadline.
+func SetDeadline(deadline time.Time) func(*Tx) {
+	return func(tx *Tx) {
+		tx.deadline = deadline
+	}
+}
+
+// SetReusePolicy is the functional option to set what Start does when the TxID is already in use, see ReusePolicy.
+func SetReusePolicy(p ReusePolicy) func(*Tx) {
+	return func(tx *Tx) {
+		tx.reuse = p
+	}
+}
+
+// SetUnfinishedPolicy is the functional option to set what rollback does with the SubTxs that never ended, unless
+// their definitions set the policy, see subtx.SetUnfinishedPolicy. By default, they're compensated.
+func SetUnfinishedPolicy(policy subtx.UnfinishedPolicy) func(*Tx) {
+	return func(tx *Tx) {
+		tx.unfinished = policy
+	}
 }
 
 // Start starts the transaction
-// If it returns any error like "could not rollback TxID", you can retry start, because the start tries rollback just once.
+// If the TxID is already in use, it's handled as per the ReusePolicy, see SetReusePolicy. With RollbackReused policy,
+// if it returns any error like "could not rollback TxID", you can retry start, because the start tries rollback just once.
 func (tx *Tx) Start() error {
+	if err := tx.checkState("start", NotStarted); err != nil {
+		return err
+	}
+	if err := tx.acquireLease(); err != nil {
+		return err
+	}
+
+	if err := tx.start(); err != nil {
+		if releaseErr := tx.releaseLease(); releaseErr != nil {
+			tx.log.Error(releaseErr)
+		}
+		return err
+	}
+
+	return tx.releaseLeaseIfDone()
+}
+
+// start logs the start of the Transaction, or handles the TxID already in use as per the ReusePolicy.
+func (tx *Tx) start() error {
+	marshalledInput, err := tx.saga.MarshallArgs(tx.input)
+	if err != nil {
+		return errors.Annotatef(err, "could not marshal input: %v", tx.input)
+	}
+
 	logMsg := &log.Log{
 		Type: log.StartTx,
+		Name: tx.name,
 		Time: time.Now(),
+		Args: marshalledInput,
+	}
+	if !tx.deadline.IsZero() {
+		logMsg.Deadline = &tx.deadline
 	}
 
 	if txIDAlreadyExists, err := tx.storage.TxIDAlreadyExists(string(tx.txID)); err != nil {
 		return errors.Annotate(err, "could not find if the TxID is already in use")
 	} else if txIDAlreadyExists {
-		tx.log.Info("TxID is already in use, calling rollback on this TxID: %s to avoid any inconsistencies", tx.txID)
-		if err = tx.Rollback(1); err != nil {
-			return errors.Annotatef(err, "could not rollback TxID: %s", tx.txID)
+		logs, err := tx.getLogs()
+		if err != nil {
+			return errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+		}
+
+		state := DeriveState(logs)
+		switch {
+		case tx.reuse == ResumeReused || (tx.reuse == IdempotentReused && state == Committed):
+			tx.log.Info("TxID: ", tx.txID, " is already in use, resuming it in state: ", state)
+			return tx.Resume()
+		case tx.reuse == RollbackReused:
+			tx.log.Info("TxID is already in use, calling rollback on this TxID: %s to avoid any inconsistencies", tx.txID)
+			if err = tx.rollback(true); err != nil {
+				return errors.Annotatef(err, "could not rollback TxID: %s", tx.txID)
+			}
+
+			if logs, err = tx.getLogs(); err != nil {
+				return errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+			}
+			tx.mu.Lock()
+			tx.seq = lastSeq(buildSteps(logs))
+			tx.mu.Unlock()
+		default:
+			return errors.Annotatef(ErrTxIDInUse, "could not start TxID: %s in state: %s", tx.txID, state)
 		}
 	}
 
@@ -83,10 +224,89 @@ func (tx *Tx) Start() error {
 		return errors.Annotatef(err, "could not start Tx: %s, because the log: %v is not serializable", tx.txID, logMsg)
 	}
 
-	if err = tx.storage.AppendLog(string(tx.txID), logData); err != nil {
+	if err = tx.appendLog(logData); err != nil {
 		return errors.Annotatef(err, "could not append logs to storage for TxID: %s", tx.txID)
 	}
 
+	tx.setState(Running)
+	tx.emit(Event{Type: EventTxStarted, Args: tx.input})
+	return nil
+}
+
+// Resume continues the already started transaction, the next SubTx execution follows the executions already logged.
+// Use it instead of Start to continue a transaction after the process restarts. The state of the transaction is
+// restored from the logs, so e.g. an ended transaction can't execute SubTxs after Resume.
+func (tx *Tx) Resume() error {
+	if err := tx.acquireLease(); err != nil {
+		return err
+	}
+
+	if err := tx.resume(); err != nil {
+		if releaseErr := tx.releaseLease(); releaseErr != nil {
+			tx.log.Error(releaseErr)
+		}
+		return err
+	}
+
+	return tx.releaseLeaseIfDone()
+}
+
+// resume restores the state of the Transaction from its logs.
+func (tx *Tx) resume() error {
+	logs, err := tx.getLogs()
+	if err != nil {
+		return errors.Annotatef(err, "could not read logs of TxID: %s", tx.txID)
+	}
+	if len(logs) == 0 {
+		return errors.Errorf("could not resume TxID: %s, it's not started", tx.txID)
+	}
+
+	steps := buildSteps(logs)
+	// the saga type and deadline are restored from the last start of the Transaction, unless they're set
+	name, deadline, lastStart := "", time.Time{}, 0
+	for i, l := range logs {
+		if l.Type == log.StartTx {
+			name, deadline, lastStart = l.Name, time.Time{}, i
+			if l.Deadline != nil {
+				deadline = *l.Deadline
+			}
+		}
+	}
+	if tx.name == "" {
+		tx.name = name
+	}
+	if tx.deadline.IsZero() {
+		tx.deadline = deadline
+	}
+
+	tx.mu.Lock()
+	tx.seq = lastSeq(steps)
+	tx.state = DeriveState(logs)
+	tx.locked = tx.locked || hasLocks(logs)
+	current := buildSteps(logs[lastStart:])
+	if tx.replay {
+		// the SubTxs are executed again from the first one since the last start of the Transaction, and matched with
+		// the logged executions that are not compensated, e.g. the ones rolled back before the TxID was reused.
+		if len(current) > 0 {
+			tx.seq = current[0].start.Seq - 1
+		}
+		tx.recorded = make(map[int]*step, len(current))
+		for _, s := range current {
+			if !s.compensating {
+				tx.recorded[s.start.Seq] = s
+			}
+		}
+	} else {
+		// the executions that never ended continue their Seq and attempts when they're executed again
+		tx.pending = nil
+		for _, s := range current {
+			if !s.ended && !s.compensating {
+				tx.pending = append(tx.pending, s)
+			}
+		}
+	}
+	tx.mu.Unlock()
+
 	return nil
 }
 
@@ -96,17 +316,27 @@ func (tx *Tx) ExecSubTx(subTxID string, args ...interface{}) error {
 	return err
 }
 
-func getErrorFrom(result []reflect.Value) error {
-	if result[0].IsNil() {
-		return nil
-	}
-	return result[0].Interface().(error)
-}
-
 // ExecSubTxAndGetResult executes and returns the results of the sub-transaction that's already defined in saga and identified by the identifier
 func (tx *Tx) ExecSubTxAndGetResult(subTxID string, args ...interface{}) ([]reflect.Value, error) {
 	var res []reflect.Value
 
+	if err := tx.checkCancelled(); err != nil {
+		return res, errors.Annotatef(err, "could not execute subTxID: %s", subTxID)
+	}
+
+	// SubTxs can be executed without starting the transaction, as it was allowed before the state was tracked
+	if err := tx.restoreState(); err != nil {
+		return res, errors.Annotatef(err, "could not execute subTxID: %s", subTxID)
+	}
+	if err := tx.checkState("execute subTxID: "+subTxID+" in", NotStarted, Running); err != nil {
+		return res, err
+	}
+	tx.setState(Running)
+
+	if err := tx.checkDeadline("execute subTxID: " + subTxID + " in"); err != nil {
+		return res, err
+	}
+
 	// validate SubTxID and get the definition from saga
 	subTxDef, err := tx.saga.GetSubTxDef(subTxID)
 	if err != nil {
@@ -119,58 +349,172 @@ func (tx *Tx) ExecSubTxAndGetResult(subTxID string, args ...interface{}) ([]refl
 		return res, errors.Annotatef(err, "could not marshal params: %v", args)
 	}
 
+	// the resources are locked before the Seq is taken, so the SubTx that failed to lock leaves no gap in the logs
+	locks, err := tx.lock(subTxDef, args)
+	if err != nil {
+		return res, err
+	}
+
 	logMsg := &log.Log{
 		Type:    log.StartSubTx,
 		SubTxID: subTxID,
-		Time:    time.Now(),
 		Args:    marshalledArgs,
+		Locks:   locks,
+	}
+	if s, ok := tx.continued(subTxID, marshalledArgs); ok {
+		logMsg.Seq, logMsg.Attempt = s.start.Seq, s.start.Attempt
+	} else {
+		logMsg.Seq = tx.nextSeq()
 	}
 
-	l, err := marshal.Marshal(logMsg)
-	if err != nil {
-		return res, errors.Annotate(err, "could not marshal log message for start of SubTx")
+	if res, ok, err := tx.replayed(subTxDef, logMsg); ok {
+		return res, err
 	}
 
-	if err := tx.storage.AppendLog(tx.txID, l); err != nil {
-		return res, errors.Annotate(err, "could not append start SubTx log for subTxID: "+subTxID)
+	// the Retriable SubTx is retried until it's successful once the Transaction can only go forward
+	untilSuccess := false
+	if subTxDef.GetKind() == subtx.Retriable {
+		logs, err := tx.getLogs()
+		if err != nil {
+			return res, errors.Annotate(err, "could not get Tx logs")
+		}
+		pivot, err := tx.pivotIndex(buildSteps(logs))
+		if err != nil {
+			return res, errors.Annotate(err, "could not find the pivot SubTx")
+		}
+		untilSuccess = pivot >= 0
 	}
 
-	// prepare actual arguments to execute SubTx
-	actualArgs := make([]reflect.Value, 0, len(args)+1) // +1 for context which is first arg
-	actualArgs = append(actualArgs, reflect.ValueOf(tx.ctx))
+	return tx.execSubTx(subTxDef, logMsg, args, untilSuccess)
+}
+
+// execSubTx executes the SubTx action with retries as per the retry policy of the definition, and logs the end of SubTx
+// along with its results. The attempts continue from the Attempt of the start log. If untilSuccess is set, the action
+// is retried until it's successful or the Transaction context is cancelled, unless the error is not retryable as per
+// the retry policy.
+func (tx *Tx) execSubTx(subTxDef subtx.Definition, logMsg *log.Log, args []interface{}, untilSuccess bool) ([]reflect.Value, error) {
+	var res []reflect.Value
+	var err error
+	subTxID := logMsg.SubTxID
+
+	// prepare actual arguments to execute SubTx, the context is passed as first arg on invoke
+	actualArgs := make([]reflect.Value, 0, len(args))
 	for _, arg := range args {
 		actualArgs = append(actualArgs, reflect.ValueOf(arg))
 	}
 
-	// execute subTx
-	tx.log.Info(fmt.Sprintf("calling action for SubTxID: %s \n", subTxID))
-	res = subTxDef.GetAction().Call(actualArgs)
-	err = getErrorFrom(res)
+	// execute subTx, retrying as per the retry policy of the definition
+	policy := subTxDef.GetRetryPolicy()
+	if untilSuccess && policy.Backoff == (retry.Backoff{}) {
+		policy.Backoff = retry.DefaultBackoff()
+	}
+	first := logMsg.Attempt + 1
+	for logMsg.Attempt = first; ; logMsg.Attempt++ {
+		res, err = tx.execSubTxAttempt(subTxDef, logMsg, actualArgs)
+		if err == nil {
+			break
+		}
+
+		cause := errors.Cause(err)
+		retries := logMsg.Attempt - first + 1
+		if untilSuccess {
+			if policy.Retryable != nil && !policy.Retryable(cause) {
+				return res, err
+			}
+		} else if !policy.ShouldRetry(retries, cause) {
+			return res, err
+		}
+
+		tx.log.Info(fmt.Sprintf("retrying SubTxID: %s, failed attempt: %d, error: %v \n", subTxID, logMsg.Attempt, cause))
+		if err := tx.wait(policy.Backoff.Delay(retries)); err != nil {
+			return res, errors.Annotatef(err, "could not retry subTxID: %s", subTxID)
+		}
+	}
+
+	// log the end of subTx action along with its results. The action has succeeded, so the results that can't be
+	// logged e.g. nil interfaces or channels are left out, unless the compensate needs them.
+	results := make([]interface{}, 0, len(res)-1)
+	for _, r := range res[1:] {
+		results = append(results, r.Interface())
+	}
+	marshalledResults, err := tx.saga.MarshallArgs(results)
 	if err != nil {
-		return res, errors.Annotatef(err, "subTx action execution returned error for subTxID: %s", subTxID)
+		if subTxDef.IsCompensateWithResults() {
+			return res, errors.Annotatef(err, "could not marshal results of subTxID: %s", subTxID)
+		}
+		tx.log.Error(fmt.Sprintf("logging end of SubTxID: %s without results, error: %v \n", subTxID, err))
+		marshalledResults = nil
+	}
+
+	// the Transaction may be aborted by another process while the action was executing, e.g. by the recovery after its
+	// deadline, then the end of SubTx can't be logged after the abort
+	if err := tx.checkLoggedState("end subTxID: "+subTxID+" in", Running); err != nil {
+		return res, err
 	}
 
-	// log the end of subTx action
 	logMsg = &log.Log{
 		Type:    log.EndSubTx,
 		SubTxID: subTxID,
+		Seq:     logMsg.Seq,
+		Attempt: logMsg.Attempt,
 		Time:    time.Now(),
+		Results: marshalledResults,
 	}
-	l, err = marshal.Marshal(logMsg)
+	l, err := marshal.Marshal(logMsg)
 	if err != nil {
 		return res, errors.Annotate(err, "could not marshal log message for end of SubTx")
 	}
 
-	err = tx.storage.AppendLog(tx.txID, l)
+	err = tx.appendLog(l)
 	if err != nil {
 		return res, errors.Annotate(err, "could not append end SubTx log for subTxID: "+subTxID)
 	}
+	tx.emit(Event{Type: EventStepSucceeded, SubTxID: subTxID, Seq: logMsg.Seq, Attempt: logMsg.Attempt, Args: args})
+
+	return res, nil
+}
+
+// execSubTxAttempt logs the start of the attempt and executes the SubTx action once.
+// If the action fails, the failure is logged for the attempt.
+func (tx *Tx) execSubTxAttempt(subTxDef subtx.Definition, logMsg *log.Log, actualArgs []reflect.Value) ([]reflect.Value, error) {
+	logMsg.Time = time.Now()
+	l, err := marshal.Marshal(logMsg)
+	if err != nil {
+		return nil, errors.Annotate(err, "could not marshal log message for start of SubTx")
+	}
+
+	if err := tx.appendLog(l); err != nil {
+		return nil, errors.Annotate(err, "could not append start SubTx log for subTxID: "+logMsg.SubTxID)
+	}
+
+	event := Event{SubTxID: logMsg.SubTxID, Seq: logMsg.Seq, Attempt: logMsg.Attempt, Args: interfaces(actualArgs)}
+	event.Type = EventStepStarted
+	tx.emit(event)
+
+	tx.log.Info(fmt.Sprintf("calling action for SubTxID: %s, attempt: %d \n", logMsg.SubTxID, logMsg.Attempt))
+	res, err := tx.invoke(subTxDef, tx.execInfo(logMsg, ActionPhase, logMsg.Attempt), actualArgs)
+	if err != nil {
+		tx.logFailure(log.FailSubTx, logMsg.SubTxID, logMsg.Seq, logMsg.Attempt, err)
+		event.Type, event.Err = EventStepFailed, err
+		tx.emit(event)
+		return res, errors.Annotatef(err, "subTx action execution returned error for subTxID: %s", logMsg.SubTxID)
+	}
 
 	return res, nil
 }
 
 // End ends the Transaction
 func (tx *Tx) End() error {
+	if err := tx.restoreState(); err != nil {
+		return errors.Annotate(err, "could not end")
+	}
+	if err := tx.checkState("end", Running); err != nil {
+		return err
+	}
+	if err := tx.checkDeadline("end"); err != nil {
+		return err
+	}
+
 	logMsg := &log.Log{
 		Type: log.EndTx,
 		Time: time.Now(),
@@ -180,23 +524,24 @@ func (tx *Tx) End() error {
 		return errors.Annotatef(err, "could not end Tx: %s, because the log: %v is not serializable", tx.txID, logMsg)
 	}
 
-	err = tx.storage.AppendLog(tx.txID, logData)
+	err = tx.appendLog(logData)
 	if err != nil {
 		return errors.Annotatef(err, "could not append end SubTx log for TxID: %s", tx.txID)
 	}
+	tx.setState(Committed)
+	tx.emit(Event{Type: EventTxCommitted})
 
 	// Cleanup
 	// TODO: free up saga, storage etc.
 
-	return nil
+	return tx.releaseLocksAndLease()
 }
 
-// RollbackWithInfiniteTries tries rolling back the transaction. It'll keep retrying the rollback until it's successful.
+// RollbackWithInfiniteTries tries rolling back the transaction. It'll keep retrying the rollback with exponential backoff
+// until it's successful or the Transaction context is cancelled. See DefaultRollbackStrategy.
 func (tx *Tx) RollbackWithInfiniteTries() {
-	for true {
-		if err := tx.rollback(); err == nil {
-			return
-		}
+	if err := tx.RollbackWithStrategy(DefaultRollbackStrategy()); err != nil {
+		tx.log.Error("stopping rollback for tx: ", tx.txID, ", ", err)
 	}
 }
 
@@ -205,49 +550,205 @@ func (tx *Tx) Rollback(tryCount int) error {
 	var err error
 	for tryCount > 0 {
 		tx.log.Info("rollback attempt: ", tryCount, "for tx: ", tx.txID)
-		if err = tx.rollback(); err == nil {
+		if err = tx.rollback(false); err == nil {
 			return nil
 		}
+		if isTerminal(err) {
+			return err
+		}
 		tryCount--
 	}
 	return err
 }
 
 // rollback once
-func (tx *Tx) rollback() error {
-	logs, err := tx.storage.GetTxLogs(tx.txID)
+// The state of each SubTx is rebuilt from the logs, so the SubTxs already compensated in a previous attempt are skipped.
+// The committed Transaction is rolled back only if committed is set, i.e. as per RollbackReused policy.
+func (tx *Tx) rollback(committed bool) error {
+	if err := tx.checkCancelled(); err != nil {
+		return errors.Annotate(err, "could not rollback")
+	}
+	if !committed {
+		if err := tx.restoreState(); err != nil {
+			return errors.Annotate(err, "could not rollback")
+		}
+	}
+	if err := tx.checkState("rollback", NotStarted, Running, Aborting, CompensationFailed, Aborted); err != nil {
+		return err
+	}
+
+	logs, err := tx.getLogs()
 	if err != nil {
-		return errors.Annotate(err, "could not get Tx logs from storage")
+		return errors.Annotate(err, "could not get Tx logs")
+	}
+
+	// the locks may be taken by the process that ran the Transaction before, e.g. before the TxID was reused
+	if hasLocks(logs) {
+		tx.mu.Lock()
+		tx.locked = true
+		tx.mu.Unlock()
+	}
+
+	steps := buildSteps(logs)
+	if pivot, err := tx.pivotIndex(steps); err != nil {
+		return errors.Annotate(err, "could not find the pivot SubTx")
+	} else if pivot >= 0 {
+		return errors.Annotatef(ErrPivotPassed, "could not rollback after subTxID: %s", steps[pivot].start.SubTxID)
 	}
+
+	// the committed Transaction is not rolled back by mistake, even if this Tx doesn't know it's committed
+	state := DeriveState(logs)
+	if state == Committed && !committed {
+		tx.setState(Committed)
+		return errors.Annotatef(ErrIllegalTransition, "could not rollback TxID: %s in state: %s", tx.txID, state)
+	}
+
+	// log the abort once, the retries of rollback continue the same abort
+	if state == Aborted {
+		tx.setState(Aborted)
+		return tx.releaseLocksAndLease()
+	}
+	if state != Aborting && state != CompensationFailed {
+		logMsg := &log.Log{
+			Type: log.AbortTx,
+			Time: time.Now(),
+		}
+		l, err := marshal.Marshal(logMsg)
+		if err != nil {
+			return errors.Annotate(err, "could not marshal abort Tx log message")
+		}
+
+		err = tx.appendLog(l)
+		if err != nil {
+			return errors.Annotate(err, "could not log abort Tx log message")
+		}
+	}
+	if state != CompensationFailed {
+		tx.setState(Aborting)
+	}
+
+	ordered, err := tx.compensationOrder(steps)
+	if err != nil {
+		return errors.Annotate(err, "could not find the compensation order")
+	}
+
+	for _, s := range ordered {
+		if err := tx.checkCancelled(); err != nil {
+			return errors.Annotate(err, "could not complete rollback")
+		}
+		if s.compensated {
+			tx.log.Info(fmt.Sprintf("skipping already compensated SubTxID: %s, seq: %d \n", s.start.SubTxID, s.start.Seq))
+			continue
+		}
+		if !s.ended {
+			compensate, err := tx.shouldCompensateUnfinished(s.start)
+			if err != nil {
+				return errors.Annotatef(err, "could not decide whether to compensate unfinished subTxID: %s", s.start.SubTxID)
+			}
+			if !compensate {
+				tx.log.Info(fmt.Sprintf("skipping unfinished SubTxID: %s, seq: %d \n", s.start.SubTxID, s.start.Seq))
+				continue
+			}
+		}
+		if err := tx.compensateSubTx(s.start, s.compensations+1); err != nil {
+			return errors.Annotatef(err, "could not compensate subTxID: %s", s.start.SubTxID)
+		}
+	}
+
+	// log the end of abort
 	logMsg := &log.Log{
-		Type: log.AbortTx,
+		Type: log.AbortedTx,
 		Time: time.Now(),
 	}
 	l, err := marshal.Marshal(logMsg)
 	if err != nil {
-		return errors.Annotate(err, "could not marshal abort Tx log message")
+		return errors.Annotate(err, "could not marshal aborted Tx log message")
 	}
 
-	err = tx.storage.AppendLog(tx.txID, l)
-	if err != nil {
-		return errors.Annotate(err, "could not log abort Tx log message")
+	if err = tx.appendLog(l); err != nil {
+		return errors.Annotate(err, "could not log aborted Tx log message")
 	}
+	tx.setState(Aborted)
+	tx.emit(Event{Type: EventTxAborted})
 
-	for _, logBytes := range logs {
-		var logData log.Log
-		if err := marshal.Unmarshal([]byte(logBytes), &logData); err != nil {
-			return errors.Annotate(err, "could not unmarshal log data during abort")
-		}
-		if logData.Type == log.StartSubTx {
-			if err := tx.CompensateSubTx(logData); err != nil {
-				return errors.Annotatef(err, "could not compensate subTxID: %s", logData.SubTxID)
+	return tx.releaseLocksAndLease()
+}
+
+// compensationOrder returns the SubTx executions in the order they must be compensated.
+// SubTxs are compensated in the reverse order of their execution i.e. LIFO, unless their definitions
+// declare a compensation priority, in which case the SubTxs with higher priority are compensated first.
+func (tx *Tx) compensationOrder(started []*step) ([]*step, error) {
+	ordered := make([]*step, 0, len(started))
+	priorities := make(map[string]int, len(started))
+	for i := len(started) - 1; i >= 0; i-- {
+		subTxID := started[i].start.SubTxID
+		if _, ok := priorities[subTxID]; !ok {
+			subTxDef, err := tx.saga.GetSubTxDef(subTxID)
+			if err != nil {
+				return nil, errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", subTxID)
 			}
+			priorities[subTxID] = subTxDef.GetCompensationPriority()
 		}
+		ordered = append(ordered, started[i])
 	}
 
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return priorities[ordered[i].start.SubTxID] > priorities[ordered[j].start.SubTxID]
+	})
+
+	return ordered, nil
+}
+
+// checkCancelled returns ErrTxCancelled if the Transaction context is done.
+func (tx *Tx) checkCancelled() error {
+	if err := tx.ctx.Err(); err != nil {
+		return errors.Annotate(ErrTxCancelled, err.Error())
+	}
 	return nil
 }
 
+// nextSeq returns the Seq for the next SubTx execution in this transaction.
+func (tx *Tx) nextSeq() int {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.seq++
+	return tx.seq
+}
+
+// wait waits for the given duration, it returns ErrTxCancelled if the Transaction context is done before that.
+func (tx *Tx) wait(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-tx.ctx.Done():
+		return tx.checkCancelled()
+	}
+}
+
+// logFailure appends the failure log of a SubTx execution with the error message.
+// The failure log is informational, so the error while appending it is only traced.
+func (tx *Tx) logFailure(typ log.Type, subTxID string, seq int, attempt int, failure error) {
+	logMsg := &log.Log{
+		Type:    typ,
+		SubTxID: subTxID,
+		Seq:     seq,
+		Attempt: attempt,
+		Time:    time.Now(),
+		Error:   failure.Error(),
+	}
+
+	l, err := marshal.Marshal(logMsg)
+	if err == nil {
+		err = tx.appendLog(l)
+	}
+	if err != nil {
+		tx.log.Error(fmt.Sprintf("could not append failure log for subTxID: %s, error: %v \n", subTxID, err))
+	}
+}
+
 // SetLogger to change the Transaction logger.
 func (tx *Tx) SetLogger(l trace.Logger) {
 	tx.log = l
@@ -263,11 +764,88 @@ func (tx *Tx) IsTxIDAlreadyInUse() (bool, error) {
 	return tx.storage.TxIDAlreadyExists(tx.txID)
 }
 
+// shouldCompensateUnfinished decides as per the unfinished policy of the SubTx definition, whether the SubTx execution
+// started with the given StartSubTx log and never ended, must be compensated.
+func (tx *Tx) shouldCompensateUnfinished(logData log.Log) (bool, error) {
+	subTxDef, err := tx.saga.GetSubTxDef(logData.SubTxID)
+	if err != nil {
+		return false, errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", logData.SubTxID)
+	}
+
+	// a failed pivot SubTx has no effect by definition, and the SubTx without compensate is never compensated
+	if subTxDef.GetKind() == subtx.Pivot || !subTxDef.HasCompensate() {
+		return false, nil
+	}
+
+	policy := subTxDef.GetUnfinishedPolicy()
+	if !subTxDef.HasUnfinishedPolicy() {
+		policy = tx.unfinished
+	}
+
+	switch policy {
+	case subtx.SkipUnfinished:
+		return false, nil
+	case subtx.ProbeUnfinished:
+		// the default policy of the Transaction can't probe the SubTx without status probe
+		if !subTxDef.GetStatusProbe().IsValid() {
+			return true, nil
+		}
+		args, err := tx.saga.UnmarshallArgs(logData.Args)
+		if err != nil {
+			return false, errors.Annotate(err, "could not unmarshall status probe arguments")
+		}
+
+		tx.log.Info(fmt.Sprintf("calling status probe for SubTxID: %s \n", logData.SubTxID))
+		res, err := tx.invoke(subTxDef, tx.execInfo(&logData, ProbePhase, 1), args)
+		if err != nil {
+			return false, errors.Annotatef(err, "status probe returned error for subTxID: %s", logData.SubTxID)
+		}
+		return res[1].Bool(), nil
+	default:
+		return true, nil
+	}
+}
+
+// CompensateSubTx compensates the SubTx execution started with the given StartSubTx log.
+// If the definition asks for the action results, they're taken from the Results of the log,
+// or zero values are passed if the action never ended.
 func (tx *Tx) CompensateSubTx(logData log.Log) error {
+	logs, err := tx.getLogs()
+	if err != nil {
+		return errors.Annotate(err, "could not get Tx logs")
+	}
+
+	// the compensate attempts continue the logged ones
+	attempt := 1
+	for _, s := range buildSteps(logs) {
+		if s.start.Seq == logData.Seq && s.start.SubTxID == logData.SubTxID {
+			attempt = s.compensations + 1
+		}
+	}
+
+	return tx.compensateSubTx(logData, attempt)
+}
+
+// compensateSubTx compensates the SubTx execution, the attempt is the compensation pass of the execution.
+func (tx *Tx) compensateSubTx(logData log.Log, attempt int) error {
+	// validate SubTxID and get the definition from saga
+	subTxDef, err := tx.saga.GetSubTxDef(logData.SubTxID)
+	if err != nil {
+		return errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", logData.SubTxID)
+	}
+
+	// the ReadOnly SubTx and the one without compensate are only logged for audit, they have nothing to compensate
+	if !subTxDef.HasCompensate() {
+		tx.log.Info(fmt.Sprintf("skipping SubTxID: %s without compensate, seq: %d \n", logData.SubTxID, logData.Seq))
+		return nil
+	}
+
 	// log the starting of subTx compensate
 	logMsg := &log.Log{
 		Type:    log.StartCompensateSubTx,
 		SubTxID: logData.SubTxID,
+		Seq:     logData.Seq,
+		Attempt: attempt,
 		Time:    time.Now(),
 	}
 
@@ -276,49 +854,69 @@ func (tx *Tx) CompensateSubTx(logData log.Log) error {
 		return errors.Annotate(err, "could not marshal log message for start of compensate SubTx")
 	}
 
-	if err := tx.storage.AppendLog(tx.txID, l); err != nil {
+	if err := tx.appendLog(l); err != nil {
 		return errors.Annotate(err, "could not append start compensate SubTx log for subTxID: "+logData.SubTxID)
 	}
 
-	// validate SubTxID and get the definition from saga
-	subTxDef, err := tx.saga.GetSubTxDef(logData.SubTxID)
-	if err != nil {
-		return errors.Annotatef(err, "could not get SubTx definition for subTxID: %s", logData.SubTxID)
-	}
-
 	// prepare actual arguments to execute SubTx compensate
 	args, err := tx.saga.UnmarshallArgs(logData.Args)
 	if err != nil {
 		return errors.Annotate(err, "could not unmarshall compensate arguments")
 	}
 
-	actualArgs := make([]reflect.Value, 0, len(args)+1)
-	actualArgs = append(actualArgs, reflect.ValueOf(tx.ctx))
+	actualArgs := make([]reflect.Value, 0, len(args)+len(logData.Results))
 	actualArgs = append(actualArgs, args...)
 
+	if subTxDef.IsCompensateWithResults() {
+		results, err := tx.saga.UnmarshallArgs(logData.Results)
+		if err != nil {
+			return errors.Annotate(err, "could not unmarshall compensate results")
+		}
+		actualArgs = append(actualArgs, results...)
+
+		compensateType := subTxDef.GetCompensate().Type()
+		for i := len(actualArgs) + 1; i < compensateType.NumIn(); i++ { // +1 for context which is first arg
+			actualArgs = append(actualArgs, reflect.Zero(compensateType.In(i)))
+		}
+	}
+
+	event := Event{SubTxID: logData.SubTxID, Seq: logData.Seq, Attempt: attempt, Args: interfaces(actualArgs)}
+	event.Type = EventCompensationStarted
+	tx.emit(event)
+
 	// execute subTx compensate
 	tx.log.Info(fmt.Sprintf("calling compensate for SubTxID: %s \n", logData.SubTxID))
-	res := subTxDef.GetCompensate().Call(actualArgs)
-	err = getErrorFrom(res)
-	if err != nil {
-		return errors.Annotatef(err, "subTx action execution returned error for subTxID: %s", logData.SubTxID)
+	if _, err = tx.invoke(subTxDef, tx.execInfo(&logData, CompensatePhase, attempt), actualArgs); err != nil {
+		tx.logFailure(log.FailCompensateSubTx, logData.SubTxID, logData.Seq, attempt, err)
+		event.Type, event.Err = EventCompensationFailed, err
+		tx.emit(event)
+		return errors.Annotatef(err, "subTx compensate execution returned error for subTxID: %s", logData.SubTxID)
 	}
 
-	// log the end of subTx action
+	// another rollback of the Transaction may have completed while the compensate was executing
+	if err := tx.checkLoggedState("end compensate of subTxID: "+logData.SubTxID+" in", NotStarted, Running, Aborting, CompensationFailed); err != nil {
+		return err
+	}
+
+	// log the end of subTx compensate
 	logMsg = &log.Log{
-		Type:    log.EndSubTx,
+		Type:    log.EndCompensateSubTx,
 		SubTxID: logData.SubTxID,
+		Seq:     logData.Seq,
+		Attempt: attempt,
 		Time:    time.Now(),
 	}
 	l, err = marshal.Marshal(logMsg)
 	if err != nil {
-		return errors.Annotate(err, "could not marshal log message for end of SubTx")
+		return errors.Annotate(err, "could not marshal log message for end of compensate SubTx")
 	}
 
-	err = tx.storage.AppendLog(tx.txID, l)
+	err = tx.appendLog(l)
 	if err != nil {
-		return errors.Annotate(err, "could not append end SubTx log for subTxID: "+logData.SubTxID)
+		return errors.Annotate(err, "could not append end compensate SubTx log for subTxID: "+logData.SubTxID)
 	}
+	event.Type = EventCompensationSucceeded
+	tx.emit(event)
 
 	return nil
 }
@@ -0,0 +1,55 @@
+package saga
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/vkaushik/saga/subtx"
+	"github.com/vkaushik/saga/tx"
+)
+
+// TypedSubTx is the handle of a SubTx with typed input In and output Out, returned by AddTypedSubTx.
+// Executing it with the wrong types fails to compile, unlike ReadyTx.ExecSubTx.
+type TypedSubTx[In, Out any] struct {
+	id string
+}
+
+// AddTypedSubTx registers the SubTx identified by ID with the saga, like Saga.AddSubTx, and returns its typed handle.
+// The action takes the input and returns the error first as the other actions do, the compensate takes the same input.
+// Use a struct as In or Out to pass or return more values. The SubTx is logged in the same format as the others,
+// so it can also be executed, compensated and recovered by ID.
+func AddTypedSubTx[In, Out any](s *Saga, ID string, action func(context.Context, In) (error, Out),
+	compensate func(context.Context, In) error, options ...func(*subtx.Definition) error) (TypedSubTx[In, Out], error) {
+	if err := s.AddSubTx(ID, action, compensate, options...); err != nil {
+		return TypedSubTx[In, Out]{}, errors.Annotatef(err, "could not add typed SubTxID: %s", ID)
+	}
+
+	return TypedSubTx[In, Out]{id: ID}, nil
+}
+
+// ID returns the SubTxID.
+func (s TypedSubTx[In, Out]) ID() string {
+	return s.id
+}
+
+// Exec executes the SubTx in the Transaction with given input and returns the output of its action.
+func (s TypedSubTx[In, Out]) Exec(t tx.ReadyTx, in In) (Out, error) {
+	var out Out
+	res, err := t.ExecSubTxAndGetResult(s.id, in)
+	if err != nil {
+		return out, err
+	}
+
+	// the output of nil interface or pointer has no value to assert
+	if len(res) < 2 || !res[1].IsValid() {
+		return out, nil
+	}
+	if v := res[1].Interface(); v != nil {
+		var ok bool
+		if out, ok = v.(Out); !ok {
+			return out, errors.Errorf("subTxID: %s returned unexpected output type: %T", s.id, v)
+		}
+	}
+
+	return out, nil
+}
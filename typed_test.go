@@ -0,0 +1,66 @@
+package saga
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/vkaushik/saga/storage/memory"
+	"github.com/vkaushik/saga/tx"
+)
+
+type transfer struct {
+	Amount  int
+	Account string
+}
+
+type receipt struct {
+	ID string
+}
+
+func TestTypedSubTx(t *testing.T) {
+	rec := &recorder{}
+	sagaForTx := New()
+	debit, err := AddTypedSubTx(sagaForTx, "debit",
+		func(c context.Context, in transfer) (error, receipt) {
+			rec.record("debit-" + in.Account)
+			return nil, receipt{ID: "receipt-of-" + in.Account}
+		},
+		func(c context.Context, in transfer) error {
+			rec.record("refund-" + in.Account)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := memory.NewLogStorage()
+	readyTx := tx.New(context.Background(), sagaForTx, storage, "typed")
+	if err := readyTx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := debit.Exec(readyTx, transfer{Amount: 100, Account: "sam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != "receipt-of-sam" {
+		t.Fatalf("unexpected output: %+v", out)
+	}
+
+	// the replayed output is restored from the logs
+	replayed := tx.New(context.Background(), sagaForTx, storage, "typed", tx.SetReplay())
+	if err := replayed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = debit.Exec(replayed, transfer{Amount: 100, Account: "sam"}); err != nil || out.ID != "receipt-of-sam" {
+		t.Fatalf("unexpected replayed output: %+v, %v", out, err)
+	}
+
+	if err := readyTx.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"debit-sam", "refund-sam"}
+	if !reflect.DeepEqual(rec.calls, expected) {
+		t.Fatalf("expected calls: %v, got: %v", expected, rec.calls)
+	}
+}